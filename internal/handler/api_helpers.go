@@ -2,80 +2,603 @@ package handler
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/everettraven/rbac-proxy-poc/internal/rbac"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-// getResourceForKind is a helper function for getting the pluralized resource for a given Kind
-func getResourceForKind(kind string) string {
-	// lowercase and pluralized Kind represents the resource
-	return strings.ToLower(kind) + "s"
+// getResourceForKind is a helper function for getting the resource for a given GroupVersionKind.
+// The resource is resolved using the provided meta.RESTMapper.
+func getResourceForKind(mapper meta.RESTMapper, gvk schema.GroupVersionKind) (schema.GroupVersionResource, error) {
+	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return schema.GroupVersionResource{}, fmt.Errorf("encountered an error getting the resource for %s: %w", gvk, err)
+	}
+
+	return mapping.Resource, nil
+}
+
+// hasPermission is a helper function to determine if the given Permissions
+// include the verb for the group and resource of the GroupVersionResource.
+// Returns a bool that is true if the verb is permitted and false if it is not
+func hasPermission(perms rbac.Permissions, gvr schema.GroupVersionResource, verb string) bool {
+	return perms.Allows(gvr.Group, gvr.Resource, verb)
 }
 
 // getPermittedNamespaces is a helper function to get a list of namespaces that have the given verb as
-// a permission for the provided GroupVersionKind. It returns a list of namespaces.
-func getPermittedNamespaces(nsPerms rbac.NamespacedPermissions, gvk schema.GroupVersionKind, verb string) []string {
-	namespaces := []string{}
-	resource := getResourceForKind(gvk.Kind)
-	for namespace, permissions := range nsPerms {
-		if _, ok := permissions[resource]; ok {
-			if _, ok := permissions[resource]["*"]; ok { // has all permissions for the resource
-				namespaces = append(namespaces, namespace)
-			} else if _, ok := permissions[resource][verb]; ok { // has verb permissions for the resource
-				namespaces = append(namespaces, namespace)
+// a permission for the provided GroupVersionResource in the PermissionsSnapshot. Namespaces that are
+// terminating are left out. It returns a sorted list of namespaces.
+func getPermittedNamespaces(perms *rbac.PermissionsSnapshot, gvr schema.GroupVersionResource, verb string) []string {
+	return perms.PermittedNamespaces(gvr.Group, gvr.Resource, verb)
+}
+
+// getKindList is a helper function to get the list Kind of a given Kind (i.e. PodList from Pod)
+func getKindList(kind string) string {
+	return kind + "List"
+}
+
+// namespaceSource is a namespace that contributes resources to a merged list
+type namespaceSource struct {
+	// The namespace
+	namespace string
+	// The resource names that are permitted in the namespace, nil if the resources can be listed
+	names []string
+}
+
+// getNamespaceSources is a helper function to get the namespaces that contribute resources
+// to a merged list of the provided GroupVersionResource. A namespace contributes if it has the
+// given verb as a permission or if the cluster or namespace level permissions permit specific
+// resource names to be fetched individually in it. Namespaces that are terminating don't contribute.
+// When the field selector requires a specific `metadata.namespace` only that namespace can
+// contribute. It returns a list of namespaceSource
+// sorted by namespace and an error if the field selector is not valid.
+func getNamespaceSources(perms *rbac.PermissionsSnapshot, gvr schema.GroupVersionResource, verb string, fieldSelector string) ([]namespaceSource, error) {
+	selectedNamespace, selected, err := namespaceFromFieldSelector(fieldSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := []namespaceSource{}
+	permitted := map[string]struct{}{}
+	for _, namespace := range getPermittedNamespaces(perms, gvr, verb) {
+		permitted[namespace] = struct{}{}
+		if !selected || namespace == selectedNamespace {
+			sources = append(sources, namespaceSource{namespace: namespace})
+		}
+	}
+
+	// Resource names can be permitted by the cluster level permissions in every
+	// namespace, so every known namespace is a candidate when the namespaces are known
+	candidates := perms.Namespaces
+	if candidates == nil {
+		candidates = map[string]struct{}{}
+		for namespace := range perms.NamespacePermissions {
+			candidates[namespace] = struct{}{}
+		}
+	}
+
+	for namespace := range candidates {
+		if _, ok := permitted[namespace]; ok || !perms.HasNamespace(namespace) || (selected && namespace != selectedNamespace) {
+			continue
+		}
+
+		// Namespaces where the verb is only permitted for specific resource names by either
+		// the cluster or namespace level permissions contribute the resources that can be
+		// fetched individually
+		names := getPermittedNames(perms, gvr, namespace, "get")
+		if len(names) > 0 {
+			sources = append(sources, namespaceSource{namespace: namespace, names: names})
+		}
+	}
+
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].namespace < sources[j].namespace
+	})
+	return sources, nil
+}
+
+// getPermissionFailures is a helper function to get the namespaceFailures of the namespaces whose
+// permissions could not be discovered and that are selected by the field selector. It returns a list
+// of namespaceFailure sorted by namespace and an error if the field selector is not valid.
+func getPermissionFailures(perms *rbac.PermissionsSnapshot, fieldSelector string) ([]namespaceFailure, error) {
+	selectedNamespace, selected, err := namespaceFromFieldSelector(fieldSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	failures := []namespaceFailure{}
+	for namespace, err := range perms.FailedNamespaces {
+		if !selected || namespace == selectedNamespace {
+			failures = append(failures, namespaceFailure{namespace: namespace, err: err})
+		}
+	}
+
+	sort.Slice(failures, func(i, j int) bool {
+		return failures[i].namespace < failures[j].namespace
+	})
+	return failures, nil
+}
+
+// namespaceFromFieldSelector is a helper function to get the namespace that a field selector
+// requires with an exact match on `metadata.namespace`. It returns the namespace, a bool that
+// is true if the field selector requires a namespace, and an error if the field selector is not valid.
+func namespaceFromFieldSelector(fieldSelector string) (string, bool, error) {
+	if fieldSelector == "" {
+		return "", false, nil
+	}
+
+	selector, err := fields.ParseSelector(fieldSelector)
+	if err != nil {
+		return "", false, fmt.Errorf("encountered an error parsing field selector: %w", err)
+	}
+
+	namespace, found := selector.RequiresExactMatch("metadata.namespace")
+	return namespace, found, nil
+}
+
+// metadataFieldSelectors are the fields that a field selector can select on for every resource
+var metadataFieldSelectors = map[string]struct{}{
+	"metadata.name":      {},
+	"metadata.namespace": {},
+}
+
+// matchesSelectors is a helper function to determine if a resource matches the label and field
+// selectors of the metav1.ListOptions. Field selectors are evaluated against the fields of the
+// resource, where a field that the resource does not have is empty like it is for the API server.
+// Returns a bool that is true if the resource matches and false if it does not
+func matchesSelectors(obj *unstructured.Unstructured, opts metav1.ListOptions) bool {
+	if opts.LabelSelector != "" {
+		selector, err := labels.Parse(opts.LabelSelector)
+		if err != nil || !selector.Matches(labels.Set(obj.GetLabels())) {
+			return false
+		}
+	}
+
+	if opts.FieldSelector != "" {
+		selector, err := fields.ParseSelector(opts.FieldSelector)
+		if err != nil {
+			return false
+		}
+
+		objectFields := fields.Set{}
+		for _, req := range selector.Requirements() {
+			objectFields[req.Field] = fieldValue(obj, req.Field)
+		}
+		return selector.Matches(objectFields)
+	}
+
+	return true
+}
+
+// fieldValue is a helper function to get the value of the field with the given dot separated
+// path of a resource as it is compared by a field selector. It returns an empty string if the
+// resource does not have the field or the field is not a string, bool or number.
+func fieldValue(obj *unstructured.Unstructured, field string) string {
+	value, found, err := unstructured.NestedFieldNoCopy(obj.Object, strings.Split(field, ".")...)
+	if err != nil || !found {
+		return ""
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v
+	case bool, int64, float64, json.Number:
+		return fmt.Sprint(v)
+	}
+
+	return ""
+}
+
+// listVersion is the resourceVersion that the namespaces of a merged list are listed at
+type listVersion struct {
+	// The resourceVersion to list at
+	resourceVersion string
+	// How the resourceVersion is applied to the list
+	match metav1.ResourceVersionMatch
+}
+
+// pinned is a helper function to get the resourceVersion that a list has pinned the later pages
+// of a merged list to. It returns an empty string if no namespace has been listed yet.
+func (v listVersion) pinned() string {
+	if v.match != metav1.ResourceVersionMatchExact {
+		return ""
+	}
+
+	return v.resourceVersion
+}
+
+// getNamespacedResourceList is a helper function that when given a resourceLister, PermissionsSnapshot,
+// a verb, and the metav1.ListOptions of the request it will return a list of resources from all
+// the namespaces that include the permission verb provided for the resources of the resourceLister
+// condensed into one resource list. When a limit is set the list is paginated across the
+// namespaces, with the list continue token encoding the namespace to continue from along
+// with the upstream continue token for that namespace.
+// The first namespace is listed using the resourceVersion and resourceVersionMatch of the request
+// and every other namespace is listed at exactly the resourceVersion that the first list returned.
+// Because resourceVersions are shared by every namespace, the merged list is a consistent snapshot
+// that is reported at that resourceVersion and a merged watch can resume from it without losing events.
+// Resources that are only permitted for specific resource names are fetched individually at their
+// latest resourceVersion. Once the resourceVersion is known the namespaces are listed in parallel
+// by at most the given number of workers, and any list that is still in flight is cancelled when
+// the context is done. It returns an unstructured.UnstructuredList, the namespaceFailures of the
+// namespaces that could not be listed, and an error if the request is not valid, if the requested
+// resourceVersion is too old or if the context is done before the list is complete.
+func getNamespacedResourceList(ctx context.Context, l *resourceLister, perms *rbac.PermissionsSnapshot, verb string, opts metav1.ListOptions, workers int) (*unstructured.UnstructuredList, []namespaceFailure, error) {
+	var err error
+	if workers < 1 {
+		workers = 1
+	}
+
+	version := listVersion{
+		resourceVersion: opts.ResourceVersion,
+		match:           opts.ResourceVersionMatch,
+	}
+
+	cursor := listContinue{}
+	if opts.Continue != "" {
+		if opts.ResourceVersion != "" {
+			return nil, nil, apierrors.NewBadRequest("specifying resource version is not allowed when using continue")
+		}
+
+		cursor, err = decodeContinue(opts.Continue)
+		if err != nil {
+			return nil, nil, apierrors.NewBadRequest(err.Error())
+		}
+
+		// later pages are listed at the same resourceVersion as the first page, unless
+		// the pages before only fetched resources by name and never pinned one
+		if cursor.ResourceVersion != "" {
+			version = listVersion{
+				resourceVersion: cursor.ResourceVersion,
+				match:           metav1.ResourceVersionMatchExact,
 			}
 		}
 	}
 
-	return namespaces
+	resourceList := l.newList()
+
+	sources, err := getNamespaceSources(perms, l.gvr, verb, opts.FieldSelector)
+	if err != nil {
+		return nil, nil, apierrors.NewBadRequest(err.Error())
+	}
+	for _, src := range sources {
+		// the field selector is evaluated by the proxy for the resources that are fetched by name
+		if src.names != nil {
+			if err := l.validateFieldSelector(opts.FieldSelector); err != nil {
+				return nil, nil, err
+			}
+			break
+		}
+	}
+
+	// namespaces before the cursor were returned in previous pages
+	sources = sources[sort.Search(len(sources), func(i int) bool {
+		return sources[i].namespace >= cursor.Namespace
+	}):]
+
+	failures := []namespaceFailure{}
+	for len(sources) > 0 {
+		remaining := int64(0)
+		if opts.Limit > 0 {
+			remaining = opts.Limit - int64(len(resourceList.Items))
+		}
+
+		// The first list determines the resourceVersion of every other namespace, so the
+		// namespaces are only listed in parallel once the resourceVersion is exact. A page
+		// only lists as many namespaces at a time as there are workers to avoid listing
+		// namespaces that will not fit in the page.
+		batch := sources
+		if version.match != metav1.ResourceVersionMatchExact {
+			batch = sources[:1]
+		} else if opts.Limit > 0 && len(batch) > workers {
+			batch = sources[:workers]
+		}
+
+		results := listNamespaceSources(ctx, l, batch, cursor, remaining, version, opts, workers)
+		if ctx.Err() != nil {
+			return nil, nil, apierrors.NewTimeoutError(fmt.Sprintf("encountered a timeout listing %s", l.gvr.Resource), 0)
+		}
+
+		for i, result := range results {
+			if result.err != nil {
+				return nil, nil, result.err
+			}
+
+			// Every namespace of the batch was listed with the limit that remained before the
+			// batch, so a namespace that no longer fits in the page is listed again with the
+			// limit that remains after the namespaces before it
+			if opts.Limit > 0 {
+				remaining = opts.Limit - int64(len(resourceList.Items))
+				if int64(len(result.items)) > remaining {
+					result = listNamespaceSource(ctx, l, batch[i], cursor, remaining, version, opts)
+					if result.err != nil {
+						return nil, nil, result.err
+					}
+				}
+			}
+
+			if result.failure != nil {
+				klog.V(0).ErrorS(result.failure, fmt.Sprintf("encountered an error getting %s for namespace `%s`", l.gvr.Resource, batch[i].namespace))
+				failures = append(failures, namespaceFailure{namespace: batch[i].namespace, err: result.failure})
+			}
+
+			resourceList.Items = append(resourceList.Items, result.items...)
+			version = result.version
+
+			next := result.next
+			if next == nil && opts.Limit > 0 && int64(len(resourceList.Items)) >= opts.Limit && i+1 < len(sources) {
+				next = &listContinue{Namespace: sources[i+1].namespace, ResourceVersion: version.pinned()}
+			}
+
+			if next != nil {
+				token, err := encodeContinue(*next)
+				if err != nil {
+					return nil, nil, err
+				}
+				resourceList.SetContinue(token)
+				resourceList.SetResourceVersion(version.resourceVersion)
+				return resourceList, failures, nil
+			}
+		}
+
+		// only the first namespace can continue from the cursor
+		sources = sources[len(batch):]
+		cursor = listContinue{}
+	}
+
+	// set the resourceVersion in the event it needs to be used in a watches request
+	resourceList.SetResourceVersion(version.resourceVersion)
+	return resourceList, failures, nil
 }
 
-// getKindList is a helper function to get the list Kind of a given Kind (i.e. PodList from Pod)
-func getKindList(kind string) string {
-	return kind + "List"
+// namespaceResult is the result of listing the resources of a namespaceSource
+type namespaceResult struct {
+	// The resources of the namespace
+	items []unstructured.Unstructured
+	// The position to continue from if the namespace was not exhausted, nil if it was
+	next *listContinue
+	// The listVersion after the namespace was listed
+	version listVersion
+	// The error that should end the merged list, if any
+	err error
+	// The error that prevented the namespace from being listed completely, if any
+	failure error
 }
 
-// getNamespacedResourceList is a helper function that when given a
-// client.Client, GroupVersionKind, NamespacePermissions, and a verb it will return a list
-// of resources from all the namespaces that include the permission verb provided for the given
-// GVK condensed into one resource list. It returns an unstructured.UnstructuredList.
-func getNamespacedResourceList(cli client.Client, gvk schema.GroupVersionKind, nsPerms rbac.NamespacedPermissions, verb string) *unstructured.UnstructuredList {
-	namespaces := getPermittedNamespaces(nsPerms, gvk, verb)
+// listNamespaceSources is a helper function to list the resources of every namespaceSource
+// in parallel with at most the given number of workers. Each namespace is listed with the
+// same limit, listVersion and list options. It returns a namespaceResult for each namespaceSource
+// in the same order as the namespaceSources.
+func listNamespaceSources(ctx context.Context, l *resourceLister, sources []namespaceSource, cursor listContinue, limit int64, version listVersion, opts metav1.ListOptions, workers int) []namespaceResult {
+	results := make([]namespaceResult, len(sources))
+	sem := make(chan struct{}, workers)
+	wg := sync.WaitGroup{}
+	for i, src := range sources {
+		wg.Add(1)
+		go func(i int, src namespaceSource) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				results[i] = namespaceResult{err: ctx.Err()}
+				return
+			}
+			defer func() { <-sem }()
 
-	// Create the resource list GVK
-	listGVK := schema.GroupVersionKind{
-		Group:   gvk.Group,
-		Version: gvk.Version,
-		Kind:    getKindList(gvk.Kind),
+			results[i] = listNamespaceSource(ctx, l, src, cursor, limit, version, opts)
+		}(i, src)
 	}
 
-	resourceList := &unstructured.UnstructuredList{}
-	resourceList.SetGroupVersionKind(listGVK)
+	wg.Wait()
+	return results
+}
+
+// listNamespaceSource is a helper function to list at most limit resources of a namespaceSource
+// at the listVersion, continuing from the cursor if it is for the namespace. Resources that are
+// only permitted for specific resource names are fetched individually. Errors that make the whole
+// merged list fail are set as the error of the namespaceResult and any other error is set as the
+// failure of the namespace. It returns a namespaceResult.
+func listNamespaceSource(ctx context.Context, l *resourceLister, src namespaceSource, cursor listContinue, limit int64, version listVersion, opts metav1.ListOptions) namespaceResult {
+	resume := src.namespace == cursor.Namespace
+	result := namespaceResult{version: version}
 
-	for _, ns := range namespaces {
-		tempList := &unstructured.UnstructuredList{}
-		tempList.SetGroupVersionKind(listGVK)
+	if src.names == nil {
+		upstreamContinue := ""
+		if resume {
+			upstreamContinue = cursor.Continue
+		}
 
-		err := cli.List(context.Background(), tempList, &client.ListOptions{
-			Namespace: ns,
-		})
+		list := l.newList()
+		next, err := listNamespacePage(ctx, l, src.namespace, limit, upstreamContinue, &result.version, opts, list)
 		if err != nil {
-			klog.V(0).ErrorS(err, fmt.Sprintf("encountered an error getting %s for namespace `%s`", tempList.GetKind(), ns))
-			continue
+			if apierrors.IsResourceExpired(err) || apierrors.IsGone(err) || apierrors.IsBadRequest(err) || apierrors.IsInvalid(err) {
+				result.err = err
+				return result
+			}
+			result.failure = err
+		}
+		result.next = next
+		result.items = list.Items
+		return result
+	}
+
+	names := src.names
+	if resume && cursor.Name != "" {
+		names = names[sort.SearchStrings(names, cursor.Name):]
+	}
+	if limit > 0 && int64(len(names)) > limit {
+		result.next = &listContinue{Namespace: src.namespace, Name: names[limit], ResourceVersion: version.pinned()}
+		names = names[:limit]
+	}
+	namedList, err := getNamedResourceList(ctx, l, src.namespace, names, opts)
+	result.items = namedList.Items
+	result.failure = err
+	return result
+}
+
+// listNamespacePage is a helper function that lists the resources of the resourceLister in
+// a namespace at the listVersion and appends them to the resourceList. When limit is greater
+// than zero at most limit resources are listed, starting from the upstream continue token.
+// After a successful list the listVersion is set to exactly the resourceVersion of the list.
+// The other list options of the request, such as the label and field selectors, are
+// forwarded to the upstream list request. It returns the listContinue to continue from if
+// the limit was reached before the namespace was exhausted and nil otherwise, along with an
+// error if the namespace could not be listed. The resources of any page listed before the
+// error are left in the resourceList.
+func listNamespacePage(ctx context.Context, l *resourceLister, namespace string, limit int64, upstreamContinue string, version *listVersion, reqOpts metav1.ListOptions, resourceList *unstructured.UnstructuredList) (*listContinue, error) {
+	listed := int64(0)
+	for {
+		raw := reqOpts
+		raw.ResourceVersion = ""
+		raw.ResourceVersionMatch = ""
+		opts := &client.ListOptions{
+			Namespace: namespace,
+			Continue:  upstreamContinue,
+			Raw:       &raw,
+		}
+		if limit > 0 {
+			opts.Limit = limit - listed
+		}
+		// the upstream continue token already includes the resourceVersion to list at
+		if upstreamContinue == "" {
+			raw.ResourceVersion = version.resourceVersion
+			raw.ResourceVersionMatch = version.match
+		}
+
+		tempList, err := l.list(ctx, namespace, opts)
+		if err != nil {
+			return nil, err
 		}
 
 		// append items to list
 		resourceList.Items = append(resourceList.Items, tempList.Items...)
+		listed += int64(len(tempList.Items))
+
+		// every other namespace is listed at exactly the same resourceVersion
+		version.resourceVersion = tempList.GetResourceVersion()
+		version.match = metav1.ResourceVersionMatchExact
+
+		if tempList.GetContinue() == "" {
+			return nil, nil
+		}
+		if limit > 0 && listed >= limit {
+			return &listContinue{Namespace: namespace, Continue: tempList.GetContinue(), ResourceVersion: version.resourceVersion}, nil
+		}
+		upstreamContinue = tempList.GetContinue()
+	}
+}
+
+// getPermittedNames is a helper function to get the names of the resources that the
+// PermissionsSnapshot permits to be fetched individually with the given verb for the provided GroupVersionResource
+// in a namespace. The namespace should be empty for cluster scoped resources.
+// It returns a sorted list of resource names.
+func getPermittedNames(perms *rbac.PermissionsSnapshot, gvr schema.GroupVersionResource, namespace string, verb string) []string {
+	names := map[string]struct{}{}
+	for _, name := range perms.ClusterPermissions.ResourceNames(gvr.Group, gvr.Resource, verb) {
+		names[name] = struct{}{}
+	}
+	if namespace != "" {
+		for _, name := range perms.NamespacePermissions[namespace].ResourceNames(gvr.Group, gvr.Resource, verb) {
+			names[name] = struct{}{}
+		}
+	}
 
-		// set the resourceVersion in the event it needs to be used in a watches request
-		resourceList.SetResourceVersion(tempList.GetResourceVersion())
+	out := []string{}
+	for name := range names {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// getNamedResourceList is a helper function that when given a resourceLister,
+// namespace, and a list of resource names will get each of the
+// named resources individually and condense them into one resource list. Resources
+// that do not exist or do not match the selectors of the metav1.ListOptions are left
+// out of the list. The namespace should be empty for cluster scoped resources.
+// It returns an unstructured.UnstructuredList and the last error encountered getting a
+// resource, in which case the list only includes the resources that could be fetched.
+func getNamedResourceList(ctx context.Context, l *resourceLister, namespace string, names []string, opts metav1.ListOptions) (*unstructured.UnstructuredList, error) {
+	resourceList := l.newList()
+
+	var getErr error
+	for _, name := range names {
+		obj, err := l.get(ctx, namespace, name)
+		if err != nil {
+			if !apierrors.IsNotFound(err) {
+				klog.V(0).ErrorS(err, fmt.Sprintf("encountered an error getting %s `%s` in namespace `%s`", l.gvk.Kind, name, namespace))
+				getErr = err
+			}
+			continue
+		}
+
+		if l.matches(obj, opts) {
+			resourceList.Items = append(resourceList.Items, *obj)
+		}
+	}
+
+	return resourceList, getErr
+}
+
+// deleteNamespacedResources is a helper function that deletes the collection of resources of the given
+// GVK in each of the namespaces. The namespaces are handled in parallel by at most the given number of
+// workers. The selectors of the metav1.ListOptions choose the resources to delete and the metav1.DeleteOptions
+// are applied to every delete. It returns the namespaceFailures of the namespaces that could not be deleted from.
+func deleteNamespacedResources(ctx context.Context, cli client.Client, gvk schema.GroupVersionKind, namespaces []string, listOpts metav1.ListOptions, deleteOpts metav1.DeleteOptions, workers int) []namespaceFailure {
+	if workers < 1 {
+		workers = 1
+	}
+
+	errs := make([]error, len(namespaces))
+	sem := make(chan struct{}, workers)
+	wg := sync.WaitGroup{}
+	for i, namespace := range namespaces {
+		wg.Add(1)
+		go func(i int, namespace string) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+			defer func() { <-sem }()
+
+			obj := &unstructured.Unstructured{}
+			obj.SetGroupVersionKind(gvk)
+
+			raw := listOpts
+			rawDelete := deleteOpts
+			errs[i] = cli.DeleteAllOf(ctx, obj, &client.DeleteAllOfOptions{
+				ListOptions:   client.ListOptions{Namespace: namespace, Raw: &raw},
+				DeleteOptions: client.DeleteOptions{Raw: &rawDelete},
+			})
+		}(i, namespace)
+	}
+	wg.Wait()
+
+	failures := []namespaceFailure{}
+	for i, err := range errs {
+		if err != nil {
+			klog.V(0).ErrorS(err, fmt.Sprintf("encountered an error deleting %s in namespace `%s`", gvk.Kind, namespaces[i]))
+			failures = append(failures, namespaceFailure{namespace: namespaces[i], err: err})
+		}
 	}
 
-	return resourceList
+	return failures
 }
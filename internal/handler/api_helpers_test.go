@@ -0,0 +1,470 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/everettraven/rbac-proxy-poc/internal/rbac"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestMatchesSelectors(t *testing.T) {
+	pod := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata": map[string]interface{}{
+			"name":      "my-pod",
+			"namespace": "default",
+			"labels":    map[string]interface{}{"app": "my-app"},
+		},
+		"spec": map[string]interface{}{
+			"nodeName": "node-1",
+			"priority": int64(10),
+		},
+		"status": map[string]interface{}{
+			"phase": "Running",
+		},
+	}}
+
+	tests := []struct {
+		name    string
+		opts    metav1.ListOptions
+		matches bool
+	}{
+		{name: "no selectors", opts: metav1.ListOptions{}, matches: true},
+		{name: "matching label", opts: metav1.ListOptions{LabelSelector: "app=my-app"}, matches: true},
+		{name: "other label", opts: metav1.ListOptions{LabelSelector: "app=other"}, matches: false},
+		{name: "matching name", opts: metav1.ListOptions{FieldSelector: "metadata.name=my-pod"}, matches: true},
+		{name: "matching spec field", opts: metav1.ListOptions{FieldSelector: "spec.nodeName=node-1"}, matches: true},
+		{name: "other spec field", opts: metav1.ListOptions{FieldSelector: "spec.nodeName=node-2"}, matches: false},
+		{name: "matching status field", opts: metav1.ListOptions{FieldSelector: "status.phase!=Pending"}, matches: true},
+		{name: "matching number field", opts: metav1.ListOptions{FieldSelector: "spec.priority=10"}, matches: true},
+		{name: "missing field is empty", opts: metav1.ListOptions{FieldSelector: "spec.serviceAccountName="}, matches: true},
+		{name: "missing field does not match a value", opts: metav1.ListOptions{FieldSelector: "spec.serviceAccountName=default"}, matches: false},
+		{name: "invalid field selector", opts: metav1.ListOptions{FieldSelector: "spec.nodeName=="}, matches: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if matches := matchesSelectors(pod, tt.opts); matches != tt.matches {
+				t.Fatalf("expected matches to be %t, got %t", tt.matches, matches)
+			}
+		})
+	}
+}
+
+func TestResourceListerValidateFieldSelector(t *testing.T) {
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+
+	tests := []struct {
+		name          string
+		lister        *resourceLister
+		fieldSelector string
+		valid         bool
+	}{
+		{name: "spec field of a list", lister: &resourceLister{gvr: gvr, format: formatList}, fieldSelector: "spec.nodeName=node-1", valid: true},
+		{name: "metadata field of metadata", lister: &resourceLister{gvr: gvr, format: formatMetadata}, fieldSelector: "metadata.name=my-pod", valid: true},
+		{name: "spec field of metadata", lister: &resourceLister{gvr: gvr, format: formatMetadata}, fieldSelector: "spec.nodeName=node-1", valid: false},
+		{name: "spec field of a table without objects", lister: &resourceLister{gvr: gvr, format: formatTable}, fieldSelector: "spec.nodeName=node-1", valid: false},
+		{name: "spec field of a table with objects", lister: &resourceLister{gvr: gvr, format: formatTable, includeObject: "Object"}, fieldSelector: "spec.nodeName=node-1", valid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.lister.validateFieldSelector(tt.fieldSelector)
+			if tt.valid && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tt.valid && (err == nil || statusForError(err).Code != http.StatusBadRequest) {
+				t.Fatalf("expected a BadRequest error, got %v", err)
+			}
+		})
+	}
+}
+
+// pagingList is a list request that was made to a pagingClient
+type pagingList struct {
+	namespace       string
+	resourceVersion string
+	match           metav1.ResourceVersionMatch
+	continued       bool
+}
+
+// pagingClient is a client.Client that lists and gets pods from a fixed set of pod names
+// per namespace. Lists are paginated by the limit with the index of the next pod as the
+// continue token and are always at resourceVersion 100.
+type pagingClient struct {
+	client.Client
+
+	pods     map[string][]string
+	failures map[string]error
+
+	mu    sync.Mutex
+	lists []pagingList
+}
+
+func (c *pagingClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	listOpts := &client.ListOptions{}
+	listOpts.ApplyOptions(opts)
+
+	c.mu.Lock()
+	c.lists = append(c.lists, pagingList{
+		namespace:       listOpts.Namespace,
+		resourceVersion: listOpts.Raw.ResourceVersion,
+		match:           listOpts.Raw.ResourceVersionMatch,
+		continued:       listOpts.Continue != "",
+	})
+	c.mu.Unlock()
+
+	if err, ok := c.failures[listOpts.Namespace]; ok {
+		return err
+	}
+
+	names := c.pods[listOpts.Namespace]
+	start := 0
+	if listOpts.Continue != "" {
+		start, _ = strconv.Atoi(listOpts.Continue)
+	}
+	end := len(names)
+	if listOpts.Limit > 0 && start+int(listOpts.Limit) < end {
+		end = start + int(listOpts.Limit)
+	}
+
+	ul := list.(*unstructured.UnstructuredList)
+	for _, name := range names[start:end] {
+		ul.Items = append(ul.Items, *testPod(listOpts.Namespace, name))
+	}
+	ul.SetResourceVersion("100")
+	if end < len(names) {
+		ul.SetContinue(strconv.Itoa(end))
+	}
+	return nil
+}
+
+func (c *pagingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	for _, name := range c.pods[key.Namespace] {
+		if name == key.Name {
+			testPod(key.Namespace, key.Name).DeepCopyInto(obj.(*unstructured.Unstructured))
+			return nil
+		}
+	}
+
+	return apierrors.NewNotFound(schema.GroupResource{Resource: "pods"}, key.Name)
+}
+
+// testPod is a helper function to create a pod with the given namespace and name
+func testPod(namespace string, name string) *unstructured.Unstructured {
+	pod := &unstructured.Unstructured{}
+	pod.SetAPIVersion("v1")
+	pod.SetKind("Pod")
+	pod.SetNamespace(namespace)
+	pod.SetName(name)
+	return pod
+}
+
+// listedPods is a helper function to get the namespace/name of every pod in a list
+func listedPods(list *unstructured.UnstructuredList) []string {
+	pods := []string{}
+	for _, item := range list.Items {
+		pods = append(pods, item.GetNamespace()+"/"+item.GetName())
+	}
+	return pods
+}
+
+func TestGetNamespacedResourceList(t *testing.T) {
+	gvk := schema.GroupVersionKind{Version: "v1", Kind: "Pod"}
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	listPods := rbac.Permissions{rbac.PermissionsKey("", "pods"): {"list": nil}}
+	getPods := rbac.Permissions{rbac.PermissionsKey("", "pods"): {"get": rbac.ResourceNames{"c": {}, "a": {}, "missing": {}}}}
+	perms := &rbac.PermissionsSnapshot{
+		NamespacePermissions: rbac.NamespacedPermissions{
+			"ns-a": listPods,
+			"ns-b": listPods,
+			"ns-c": getPods,
+		},
+	}
+	pods := map[string][]string{
+		"ns-a": {"a", "b", "c"},
+		"ns-b": {"a", "b"},
+		"ns-c": {"a", "b", "c"},
+	}
+
+	newLister := func(cli client.Client) *resourceLister {
+		return &resourceLister{cli: cli, gvk: gvk, gvr: gvr, format: formatList}
+	}
+
+	t.Run("merges every namespace", func(t *testing.T) {
+		cli := &pagingClient{pods: pods}
+		list, failures, err := getNamespacedResourceList(context.Background(), newLister(cli), perms, "list", metav1.ListOptions{}, 2)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(failures) > 0 {
+			t.Fatalf("unexpected failures: %v", failures)
+		}
+
+		expected := []string{"ns-a/a", "ns-a/b", "ns-a/c", "ns-b/a", "ns-b/b", "ns-c/a", "ns-c/c"}
+		if pods := listedPods(list); !reflect.DeepEqual(pods, expected) {
+			t.Fatalf("expected pods %v, got %v", expected, pods)
+		}
+		if list.GetResourceVersion() != "100" || list.GetContinue() != "" {
+			t.Fatalf("expected resourceVersion 100 without continue, got %q and %q", list.GetResourceVersion(), list.GetContinue())
+		}
+	})
+
+	t.Run("lists the first namespace at the requested resourceVersion", func(t *testing.T) {
+		cli := &pagingClient{pods: pods}
+		opts := metav1.ListOptions{ResourceVersion: "0", ResourceVersionMatch: metav1.ResourceVersionMatchNotOlderThan}
+		if _, _, err := getNamespacedResourceList(context.Background(), newLister(cli), perms, "list", opts, 2); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		expected := []pagingList{
+			{namespace: "ns-a", resourceVersion: "0", match: metav1.ResourceVersionMatchNotOlderThan},
+			{namespace: "ns-b", resourceVersion: "100", match: metav1.ResourceVersionMatchExact},
+		}
+		if !reflect.DeepEqual(cli.lists, expected) {
+			t.Fatalf("expected lists %+v, got %+v", expected, cli.lists)
+		}
+	})
+
+	t.Run("paginates across namespaces", func(t *testing.T) {
+		cli := &pagingClient{pods: pods}
+		lister := newLister(cli)
+
+		pages := [][]string{}
+		opts := metav1.ListOptions{Limit: 2}
+		for {
+			list, _, err := getNamespacedResourceList(context.Background(), lister, perms, "list", opts, 2)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if list.GetResourceVersion() != "100" {
+				t.Fatalf("expected resourceVersion 100, got %q", list.GetResourceVersion())
+			}
+			pages = append(pages, listedPods(list))
+
+			if list.GetContinue() == "" {
+				break
+			}
+			if len(pages) > 5 {
+				t.Fatalf("expected the list to end, got pages %v", pages)
+			}
+			opts.Continue = list.GetContinue()
+		}
+
+		expected := [][]string{
+			{"ns-a/a", "ns-a/b"},
+			{"ns-a/c", "ns-b/a"},
+			{"ns-b/b", "ns-c/a"},
+			{"ns-c/c"},
+		}
+		if !reflect.DeepEqual(pages, expected) {
+			t.Fatalf("expected pages %v, got %v", expected, pages)
+		}
+
+		// only the first namespace of the first page is listed at the requested resourceVersion
+		for _, l := range cli.lists[1:] {
+			if !l.continued && (l.resourceVersion != "100" || l.match != metav1.ResourceVersionMatchExact) {
+				t.Fatalf("expected later lists to be exactly at resourceVersion 100, got %+v", l)
+			}
+		}
+	})
+
+	t.Run("continues from the name of a namespace of names", func(t *testing.T) {
+		cli := &pagingClient{pods: pods}
+		token, err := encodeContinue(listContinue{Namespace: "ns-c", Name: "c", ResourceVersion: "100"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		list, _, err := getNamespacedResourceList(context.Background(), newLister(cli), perms, "list", metav1.ListOptions{Continue: token}, 2)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if pods := listedPods(list); !reflect.DeepEqual(pods, []string{"ns-c/c"}) {
+			t.Fatalf("expected pods [ns-c/c], got %v", pods)
+		}
+		if len(cli.lists) > 0 {
+			t.Fatalf("expected no lists, got %+v", cli.lists)
+		}
+	})
+
+	t.Run("continues after a page of names without a resourceVersion", func(t *testing.T) {
+		cli := &pagingClient{pods: pods}
+		namesFirst := &rbac.PermissionsSnapshot{
+			NamespacePermissions: rbac.NamespacedPermissions{
+				"ns-a": {rbac.PermissionsKey("", "pods"): {"get": rbac.ResourceNames{"a": {}, "b": {}}}},
+				"ns-b": listPods,
+			},
+		}
+
+		list, _, err := getNamespacedResourceList(context.Background(), newLister(cli), namesFirst, "list", metav1.ListOptions{Limit: 2}, 2)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if pods := listedPods(list); !reflect.DeepEqual(pods, []string{"ns-a/a", "ns-a/b"}) {
+			t.Fatalf("expected pods [ns-a/a ns-a/b], got %v", pods)
+		}
+		cursor, err := decodeContinue(list.GetContinue())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cursor.ResourceVersion != "" {
+			t.Fatalf("expected no resourceVersion in the continue token, got %q", cursor.ResourceVersion)
+		}
+
+		list, _, err = getNamespacedResourceList(context.Background(), newLister(cli), namesFirst, "list", metav1.ListOptions{Limit: 2, Continue: list.GetContinue()}, 2)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if pods := listedPods(list); !reflect.DeepEqual(pods, []string{"ns-b/a", "ns-b/b"}) {
+			t.Fatalf("expected pods [ns-b/a ns-b/b], got %v", pods)
+		}
+
+		expected := []pagingList{{namespace: "ns-b"}}
+		if !reflect.DeepEqual(cli.lists, expected) {
+			t.Fatalf("expected lists %+v, got %+v", expected, cli.lists)
+		}
+	})
+
+	t.Run("reports namespaces that fail", func(t *testing.T) {
+		cli := &pagingClient{pods: pods, failures: map[string]error{"ns-b": errors.New("connection refused")}}
+		list, failures, err := getNamespacedResourceList(context.Background(), newLister(cli), perms, "list", metav1.ListOptions{}, 2)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(failures) != 1 || failures[0].namespace != "ns-b" {
+			t.Fatalf("expected ns-b to fail, got %v", failures)
+		}
+
+		expected := []string{"ns-a/a", "ns-a/b", "ns-a/c", "ns-c/a", "ns-c/c"}
+		if pods := listedPods(list); !reflect.DeepEqual(pods, expected) {
+			t.Fatalf("expected pods %v, got %v", expected, pods)
+		}
+	})
+
+	t.Run("fails when the resourceVersion is expired", func(t *testing.T) {
+		cli := &pagingClient{pods: pods, failures: map[string]error{"ns-a": apierrors.NewResourceExpired("too old")}}
+		_, _, err := getNamespacedResourceList(context.Background(), newLister(cli), perms, "list", metav1.ListOptions{}, 2)
+		if !apierrors.IsResourceExpired(err) {
+			t.Fatalf("expected an expired error, got %v", err)
+		}
+	})
+
+	badRequests := []struct {
+		name string
+		opts metav1.ListOptions
+	}{
+		{name: "continue with a resourceVersion", opts: metav1.ListOptions{Continue: "token", ResourceVersion: "100"}},
+		{name: "invalid continue", opts: metav1.ListOptions{Continue: "not a token!"}},
+	}
+	for _, tt := range badRequests {
+		t.Run(tt.name, func(t *testing.T) {
+			cli := &pagingClient{pods: pods}
+			_, _, err := getNamespacedResourceList(context.Background(), newLister(cli), perms, "list", tt.opts, 2)
+			if !apierrors.IsBadRequest(err) {
+				t.Fatalf("expected a BadRequest error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestGetNamespaceSources(t *testing.T) {
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	listPods := rbac.Permissions{rbac.PermissionsKey("", "pods"): {"list": nil}}
+	getPod := func(names ...string) rbac.Permissions {
+		set := rbac.ResourceNames{}
+		for _, name := range names {
+			set[name] = struct{}{}
+		}
+		return rbac.Permissions{rbac.PermissionsKey("", "pods"): {"get": set}}
+	}
+
+	tests := []struct {
+		name          string
+		perms         *rbac.PermissionsSnapshot
+		fieldSelector string
+		sources       []namespaceSource
+	}{
+		{
+			name: "namespace level names",
+			perms: &rbac.PermissionsSnapshot{
+				NamespacePermissions: rbac.NamespacedPermissions{"ns-a": listPods, "ns-b": getPod("b")},
+			},
+			sources: []namespaceSource{{namespace: "ns-a"}, {namespace: "ns-b", names: []string{"b"}}},
+		},
+		{
+			name: "cluster level names in every known namespace",
+			perms: &rbac.PermissionsSnapshot{
+				ClusterPermissions:   getPod("a"),
+				NamespacePermissions: rbac.NamespacedPermissions{"ns-a": listPods, "ns-b": getPod("b")},
+				Namespaces:           map[string]struct{}{"ns-a": {}, "ns-b": {}, "ns-c": {}},
+			},
+			sources: []namespaceSource{{namespace: "ns-a"}, {namespace: "ns-b", names: []string{"a", "b"}}, {namespace: "ns-c", names: []string{"a"}}},
+		},
+		{
+			name: "cluster level names without known namespaces",
+			perms: &rbac.PermissionsSnapshot{
+				ClusterPermissions:   getPod("a"),
+				NamespacePermissions: rbac.NamespacedPermissions{"ns-b": rbac.Permissions{}},
+			},
+			sources: []namespaceSource{{namespace: "ns-b", names: []string{"a"}}},
+		},
+		{
+			name: "selected namespace",
+			perms: &rbac.PermissionsSnapshot{
+				ClusterPermissions: getPod("a"),
+				Namespaces:         map[string]struct{}{"ns-a": {}, "ns-b": {}},
+			},
+			fieldSelector: "metadata.namespace=ns-b",
+			sources:       []namespaceSource{{namespace: "ns-b", names: []string{"a"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sources, err := getNamespaceSources(tt.perms, gvr, "list", tt.fieldSelector)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(sources, tt.sources) {
+				t.Fatalf("expected sources %+v, got %+v", tt.sources, sources)
+			}
+		})
+	}
+}
+
+func TestGetPermissionFailures(t *testing.T) {
+	unavailable := errors.New("unavailable")
+	perms := &rbac.PermissionsSnapshot{FailedNamespaces: map[string]error{"ns-b": unavailable, "ns-a": unavailable}}
+
+	failures, err := getPermissionFailures(perms, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []namespaceFailure{{namespace: "ns-a", err: unavailable}, {namespace: "ns-b", err: unavailable}}; !reflect.DeepEqual(failures, want) {
+		t.Fatalf("expected failures %v, got %v", want, failures)
+	}
+
+	failures, err = getPermissionFailures(perms, "metadata.namespace=ns-b")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []namespaceFailure{{namespace: "ns-b", err: unavailable}}; !reflect.DeepEqual(failures, want) {
+		t.Fatalf("expected failures %v, got %v", want, failures)
+	}
+
+	if _, err := getPermissionFailures(perms, "metadata.namespace"); err == nil {
+		t.Fatal("expected an error for an invalid field selector")
+	}
+}
@@ -0,0 +1,623 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/everettraven/rbac-proxy-poc/internal/rbac"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// rulesReviewWorkers is the maximum number of SelfSubjectRulesReviews that are created concurrently
+	rulesReviewWorkers = 10
+	// rulesReviewTimeout is how long a SelfSubjectRulesReview can take before it fails
+	rulesReviewTimeout = 30 * time.Second
+)
+
+// AuthorizerMode is how the permissions of a caller are decided
+type AuthorizerMode string
+
+const (
+	// AuthorizerModeRBAC decides from the RBAC of the cluster that is cached by an RBACWatcher
+	AuthorizerModeRBAC AuthorizerMode = "RBAC"
+	// AuthorizerModeSubjectAccessReview asks the authorizer of the Kubernetes API server
+	AuthorizerModeSubjectAccessReview AuthorizerMode = "SubjectAccessReview"
+)
+
+// Authorizer decides what the caller of a proxy request is permitted to do
+type Authorizer interface {
+	// HasSynced returns whether or not the Authorizer is ready to make decisions
+	HasSynced() bool
+	// ForRequest returns the RequestAuthorizer that every decision about a single request is made with
+	ForRequest() RequestAuthorizer
+	// Subscribe registers a new subscriber that is notified whenever the permissions
+	// may have changed and returns a function that cancels the subscription
+	Subscribe() (<-chan struct{}, func())
+}
+
+// RequestAuthorizer makes the decisions about a single proxy request, so that
+// the whole request is evaluated against a consistent view of the permissions
+type RequestAuthorizer interface {
+	// Authorize returns whether or not the verb is permitted for every resource of the
+	// GroupVersionResource in the namespace, or at the cluster level when it is empty
+	Authorize(ctx context.Context, gvr schema.GroupVersionResource, namespace string, verb string) (bool, error)
+	// Permissions returns the PermissionsSnapshot that the namespaces and resource
+	// names that a cluster level request is fanned out to are discovered from
+	Permissions(ctx context.Context) (*rbac.PermissionsSnapshot, error)
+	// PermittedNames returns the sorted names of the resources of the GroupVersionResource that
+	// the verb is permitted for at the cluster level or, when one is given, in the namespace
+	PermittedNames(ctx context.Context, gvr schema.GroupVersionResource, namespace string, verb string) ([]string, error)
+}
+
+// IdentityAuthorizers gets the Authorizer for each identity that requests are made as
+type IdentityAuthorizers interface {
+	// HasSynced returns whether or not the IdentityAuthorizers are ready to make decisions
+	HasSynced() bool
+	// AuthorizerFor returns the Authorizer for the given rbac.Identity
+	AuthorizerFor(ctx context.Context, identity rbac.Identity) (Authorizer, error)
+}
+
+// RBACAuthorizer is an Authorizer that decides from the permissions of an RBACWatcher
+type RBACAuthorizer struct {
+	// The RBACWatcher of the caller
+	watcher *rbac.RBACWatcher
+}
+
+// NewRBACAuthorizer creates a new RBACAuthorizer that decides from the permissions of the given RBACWatcher
+func NewRBACAuthorizer(watcher *rbac.RBACWatcher) *RBACAuthorizer {
+	return &RBACAuthorizer{watcher: watcher}
+}
+
+// HasSynced returns whether or not the permissions of the RBACWatcher have synced
+func (a *RBACAuthorizer) HasSynced() bool {
+	return a.watcher.HasSynced()
+}
+
+// ForRequest returns a RequestAuthorizer that makes every decision
+// against the latest PermissionsSnapshot of the RBACWatcher
+func (a *RBACAuthorizer) ForRequest() RequestAuthorizer {
+	return &snapshotAuthorizer{perms: a.watcher.Snapshot()}
+}
+
+// Subscribe registers a new subscriber that is notified whenever the permissions of the RBACWatcher change
+func (a *RBACAuthorizer) Subscribe() (<-chan struct{}, func()) {
+	return a.watcher.Subscribe()
+}
+
+// snapshotAuthorizer is a RequestAuthorizer that decides from a single PermissionsSnapshot
+type snapshotAuthorizer struct {
+	// The PermissionsSnapshot that decisions are made against
+	perms *rbac.PermissionsSnapshot
+}
+
+// Authorize returns whether or not the PermissionsSnapshot includes the verb for the
+// GroupVersionResource at the cluster level or, when one is given, in the namespace
+func (a *snapshotAuthorizer) Authorize(ctx context.Context, gvr schema.GroupVersionResource, namespace string, verb string) (bool, error) {
+	return hasPermission(a.perms.ClusterPermissions, gvr, verb) ||
+		(namespace != "" && hasPermission(a.perms.NamespacePermissions[namespace], gvr, verb)), nil
+}
+
+// Permissions returns the PermissionsSnapshot
+func (a *snapshotAuthorizer) Permissions(ctx context.Context) (*rbac.PermissionsSnapshot, error) {
+	return a.perms, nil
+}
+
+// PermittedNames returns the names of the resources that the PermissionsSnapshot
+// permits the verb for at the cluster level or, when one is given, in the namespace
+func (a *snapshotAuthorizer) PermittedNames(ctx context.Context, gvr schema.GroupVersionResource, namespace string, verb string) ([]string, error) {
+	return getPermittedNames(a.perms, gvr, namespace, verb), nil
+}
+
+// RBACIdentityAuthorizers are the RBACAuthorizers of the RBACWatchers of an RBACWatcherSet
+type RBACIdentityAuthorizers struct {
+	// The RBACWatchers of the identities
+	watchers *rbac.RBACWatcherSet
+}
+
+// NewRBACIdentityAuthorizers creates new RBACIdentityAuthorizers for the RBACWatchers of the given RBACWatcherSet
+func NewRBACIdentityAuthorizers(watchers *rbac.RBACWatcherSet) *RBACIdentityAuthorizers {
+	return &RBACIdentityAuthorizers{watchers: watchers}
+}
+
+// HasSynced returns whether or not the informers of the RBACWatcherSet have synced
+func (a *RBACIdentityAuthorizers) HasSynced() bool {
+	return a.watchers.HasSynced()
+}
+
+// AuthorizerFor returns an RBACAuthorizer for the RBACWatcher of the given rbac.Identity
+func (a *RBACIdentityAuthorizers) AuthorizerFor(ctx context.Context, identity rbac.Identity) (Authorizer, error) {
+	watcher, err := a.watchers.WatcherFor(ctx, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewRBACAuthorizer(watcher), nil
+}
+
+// authorizationKey is the key of a cached decision
+type authorizationKey struct {
+	// The group of the resource
+	group string
+	// The resource
+	resource string
+	// The namespace, empty at the cluster level
+	namespace string
+	// The verb
+	verb string
+}
+
+// cachedDecision is a decision of the authorizer of the Kubernetes API server
+type cachedDecision struct {
+	// Whether or not the verb is permitted
+	allowed bool
+	// When the decision must be made again
+	expires time.Time
+}
+
+// cachedRules are the permissions of a namespace that were discovered by a SelfSubjectRulesReview
+type cachedRules struct {
+	// The permissions
+	permissions rbac.Permissions
+	// When the rules must be reviewed again
+	expires time.Time
+}
+
+// rulesReview is a SelfSubjectRulesReview of a namespace that is shared by every caller
+// that asks for the rules of the namespace while it is in flight
+type rulesReview struct {
+	// The channel that is closed once the review is done
+	done chan struct{}
+	// The permissions of the namespace, nil if the review failed
+	permissions rbac.Permissions
+	// The error the review failed with, if any
+	err error
+}
+
+// SubjectAccessReviewAuthorizer is an Authorizer that asks the authorizer of the Kubernetes API server,
+// so the decisions include every authorizer the API server is configured with. Decisions are made with
+// SelfSubjectAccessReviews for the identity of the client, or with SubjectAccessReviews when the decisions
+// are for another identity. The namespaces that requests are fanned out to are discovered by creating a
+// SelfSubjectRulesReview for every namespace of the cluster, and the cluster level permissions with a
+// SelfSubjectRulesReview without a namespace. Decisions and discovered permissions are cached for the
+// TTL of the SubjectAccessReviewAuthorizer.
+type SubjectAccessReviewAuthorizer struct {
+	// The client used to create the SubjectAccessReviews and to list the namespaces
+	client client.Client
+	// The client used to create the SelfSubjectAccessReviews and SelfSubjectRulesReviews as the caller
+	selfClient client.Client
+	// The identity that decisions are made for, nil when they are made for the identity of the client
+	identity *rbac.Identity
+	// How long decisions and discovered permissions are cached
+	ttl time.Duration
+
+	// The lock for the decisions
+	mu sync.Mutex
+	// The cached decisions
+	decisions map[authorizationKey]cachedDecision
+
+	// The lock for the rules and the reviews
+	rulesMu sync.Mutex
+	// The cached rules keyed by namespace, the cluster level rules have an empty key
+	rules map[string]cachedRules
+	// The SelfSubjectRulesReviews that are in flight keyed by namespace
+	reviews map[string]*rulesReview
+
+	// The lock for the permissions
+	permissionsMu sync.Mutex
+	// The discovered permissions, nil if they have not been discovered
+	permissions *rbac.PermissionsSnapshot
+	// When the permissions must be discovered again
+	permissionsExpire time.Time
+}
+
+// NewSelfSubjectAccessReviewAuthorizer creates a new SubjectAccessReviewAuthorizer that makes
+// decisions for the identity of the given client.Client and caches them for the given TTL
+func NewSelfSubjectAccessReviewAuthorizer(cli client.Client, ttl time.Duration) *SubjectAccessReviewAuthorizer {
+	return &SubjectAccessReviewAuthorizer{
+		client:     cli,
+		selfClient: cli,
+		ttl:        ttl,
+		decisions:  map[authorizationKey]cachedDecision{},
+		rules:      map[string]cachedRules{},
+		reviews:    map[string]*rulesReview{},
+	}
+}
+
+// NewSubjectAccessReviewAuthorizer creates a new SubjectAccessReviewAuthorizer that makes decisions for
+// the given rbac.Identity with the given client.Client and caches them for the given TTL. The permissions
+// are discovered with the given impersonating client.Client that makes requests as the rbac.Identity.
+func NewSubjectAccessReviewAuthorizer(cli client.Client, impersonating client.Client, identity rbac.Identity, ttl time.Duration) *SubjectAccessReviewAuthorizer {
+	return &SubjectAccessReviewAuthorizer{
+		client:     cli,
+		selfClient: impersonating,
+		identity:   &identity,
+		ttl:        ttl,
+		decisions:  map[authorizationKey]cachedDecision{},
+		rules:      map[string]cachedRules{},
+		reviews:    map[string]*rulesReview{},
+	}
+}
+
+// HasSynced always returns true, the SubjectAccessReviewAuthorizer does not have to sync
+func (a *SubjectAccessReviewAuthorizer) HasSynced() bool {
+	return true
+}
+
+// ForRequest returns the SubjectAccessReviewAuthorizer itself, the decisions
+// about a request are made against the cached decisions and permissions
+func (a *SubjectAccessReviewAuthorizer) ForRequest() RequestAuthorizer {
+	return a
+}
+
+// Authorize returns whether or not the authorizer of the Kubernetes API server permits the verb for the
+// GroupVersionResource in the namespace, or at the cluster level when it is empty
+func (a *SubjectAccessReviewAuthorizer) Authorize(ctx context.Context, gvr schema.GroupVersionResource, namespace string, verb string) (bool, error) {
+	key := authorizationKey{group: gvr.Group, resource: gvr.Resource, namespace: namespace, verb: verb}
+	if allowed, ok := a.cachedDecision(key); ok {
+		return allowed, nil
+	}
+
+	attributes := &authorizationv1.ResourceAttributes{
+		Namespace: namespace,
+		Verb:      verb,
+		Group:     gvr.Group,
+		Version:   gvr.Version,
+		Resource:  gvr.Resource,
+	}
+
+	var status authorizationv1.SubjectAccessReviewStatus
+	if a.identity == nil {
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: attributes},
+		}
+		if err := a.client.Create(ctx, review); err != nil {
+			return false, fmt.Errorf("encountered an error creating a SelfSubjectAccessReview: %w", err)
+		}
+		status = review.Status
+	} else {
+		extra := map[string]authorizationv1.ExtraValue{}
+		for k, v := range a.identity.Extra {
+			extra[k] = v
+		}
+		review := &authorizationv1.SubjectAccessReview{
+			Spec: authorizationv1.SubjectAccessReviewSpec{
+				ResourceAttributes: attributes,
+				User:               a.identity.User,
+				Groups:             a.identity.Groups,
+				Extra:              extra,
+			},
+		}
+		if err := a.client.Create(ctx, review); err != nil {
+			return false, fmt.Errorf("encountered an error creating a SubjectAccessReview: %w", err)
+		}
+		status = review.Status
+	}
+
+	if status.EvaluationError != "" {
+		klog.V(0).Infof("the decision for %s %s in namespace `%s` is incomplete: %s", verb, gvr.GroupResource(), namespace, status.EvaluationError)
+	}
+
+	a.cacheDecision(key, status.Allowed)
+	return status.Allowed, nil
+}
+
+// cachedDecision is a helper function to get the cached decision for the given
+// key, with a bool that is false if there is no unexpired decision
+func (a *SubjectAccessReviewAuthorizer) cachedDecision(key authorizationKey) (bool, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	decision, ok := a.decisions[key]
+	if !ok || time.Now().After(decision.expires) {
+		return false, false
+	}
+
+	return decision.allowed, true
+}
+
+// cacheDecision is a helper function to cache the decision for the given key.
+// Expired decisions are removed whenever a new decision is cached.
+func (a *SubjectAccessReviewAuthorizer) cacheDecision(key authorizationKey, allowed bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	for k, decision := range a.decisions {
+		if now.After(decision.expires) {
+			delete(a.decisions, k)
+		}
+	}
+
+	a.decisions[key] = cachedDecision{allowed: allowed, expires: now.Add(a.ttl)}
+}
+
+// Permissions returns the cluster level permissions and the permissions of every namespace of the
+// cluster as discovered by SelfSubjectRulesReviews. Cluster level decisions are still made with
+// Authorize, the cluster level permissions are used for the resource names that are permitted at
+// the cluster level. Namespaces that are terminating are left out, and namespaces whose rules can't
+// be reviewed are left out of the namespace level permissions and reported as failed namespaces.
+// Permissions with failed namespaces are not cached. It returns an error if the namespaces or the
+// cluster level rules can't be discovered.
+func (a *SubjectAccessReviewAuthorizer) Permissions(ctx context.Context) (*rbac.PermissionsSnapshot, error) {
+	a.permissionsMu.Lock()
+	if a.permissions != nil && time.Now().Before(a.permissionsExpire) {
+		defer a.permissionsMu.Unlock()
+		return a.permissions, nil
+	}
+	a.permissionsMu.Unlock()
+
+	namespaceList := &corev1.NamespaceList{}
+	if err := a.client.List(ctx, namespaceList); err != nil {
+		return nil, fmt.Errorf("encountered an error listing namespaces: %w", err)
+	}
+	namespaces := []string{}
+	active := map[string]struct{}{}
+	for i := range namespaceList.Items {
+		ns := &namespaceList.Items[i]
+		// Terminating namespaces are left out of fan out
+		if !rbac.IsActiveNamespace(ns) {
+			continue
+		}
+		namespaces = append(namespaces, ns.Name)
+		active[ns.Name] = struct{}{}
+	}
+	sort.Strings(namespaces)
+
+	results := make([]rbac.Permissions, len(namespaces))
+	errs := make([]error, len(namespaces))
+	sem := make(chan struct{}, rulesReviewWorkers)
+	var wg sync.WaitGroup
+	for i, namespace := range namespaces {
+		wg.Add(1)
+		go func(i int, namespace string) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+			defer func() { <-sem }()
+
+			results[i], errs[i] = a.rulesFor(ctx, namespace)
+		}(i, namespace)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("encountered an error discovering permissions: %w", err)
+	}
+
+	nsPerms := rbac.NamespacedPermissions{}
+	failed := map[string]error{}
+	for i, namespace := range namespaces {
+		if errs[i] != nil {
+			failed[namespace] = errs[i]
+			continue
+		}
+		if len(results[i]) > 0 {
+			nsPerms[namespace] = results[i]
+		}
+	}
+
+	clusterPerms, err := a.rulesFor(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("encountered an error discovering the cluster level permissions: %w", err)
+	}
+
+	perms := &rbac.PermissionsSnapshot{ClusterPermissions: clusterPerms, NamespacePermissions: nsPerms, Namespaces: active}
+	if len(failed) > 0 {
+		perms.FailedNamespaces = failed
+		return perms, nil
+	}
+
+	a.permissionsMu.Lock()
+	defer a.permissionsMu.Unlock()
+	a.permissions = perms
+	a.permissionsExpire = time.Now().Add(a.ttl)
+	return perms, nil
+}
+
+// PermittedNames returns the names of the resources that the verb is permitted for at the cluster level
+// or, when one is given, in the namespace. Only the rules of the cluster level and of the namespace are
+// reviewed, so the permissions of the other namespaces don't have to be discovered.
+func (a *SubjectAccessReviewAuthorizer) PermittedNames(ctx context.Context, gvr schema.GroupVersionResource, namespace string, verb string) ([]string, error) {
+	clusterPerms, err := a.rulesFor(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("encountered an error discovering the cluster level permissions: %w", err)
+	}
+
+	perms := &rbac.PermissionsSnapshot{
+		ClusterPermissions:   clusterPerms,
+		NamespacePermissions: rbac.NamespacedPermissions{},
+	}
+	if namespace != "" {
+		nsPerms, err := a.rulesFor(ctx, namespace)
+		if err != nil {
+			return nil, fmt.Errorf("encountered an error discovering the permissions of namespace `%s`: %w", namespace, err)
+		}
+		perms.NamespacePermissions[namespace] = nsPerms
+	}
+
+	return getPermittedNames(perms, gvr, namespace, verb), nil
+}
+
+// rulesFor is a helper function to get the cached Permissions in the namespace, or at the cluster
+// level when it is empty, reviewing the rules again when they have expired. Callers that ask for
+// the rules of the same namespace while they are being reviewed share the review, which runs until
+// it is done regardless of the context of any caller so that one cancelled request can't fail the
+// others. Only the rules of reviews that succeed are cached. It returns an error if the rules can't
+// be reviewed or if the context is done before the review is.
+func (a *SubjectAccessReviewAuthorizer) rulesFor(ctx context.Context, namespace string) (rbac.Permissions, error) {
+	a.rulesMu.Lock()
+	if cached, ok := a.rules[namespace]; ok && time.Now().Before(cached.expires) {
+		a.rulesMu.Unlock()
+		return cached.permissions, nil
+	}
+
+	review, ok := a.reviews[namespace]
+	if !ok {
+		review = &rulesReview{done: make(chan struct{})}
+		a.reviews[namespace] = review
+		go a.runRulesReview(namespace, review)
+	}
+	a.rulesMu.Unlock()
+
+	select {
+	case <-review.done:
+		return review.permissions, review.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// runRulesReview is a helper function that reviews the rules of the namespace for the rulesReview,
+// caches them if the review succeeds and marks the rulesReview as done
+func (a *SubjectAccessReviewAuthorizer) runRulesReview(namespace string, review *rulesReview) {
+	ctx, cancel := context.WithTimeout(context.Background(), rulesReviewTimeout)
+	defer cancel()
+
+	review.permissions, review.err = a.reviewRules(ctx, namespace)
+
+	a.rulesMu.Lock()
+	defer a.rulesMu.Unlock()
+	delete(a.reviews, namespace)
+	if review.err == nil {
+		now := time.Now()
+		for k, cached := range a.rules {
+			if now.After(cached.expires) {
+				delete(a.rules, k)
+			}
+		}
+		a.rules[namespace] = cachedRules{permissions: review.permissions, expires: now.Add(a.ttl)}
+	}
+	close(review.done)
+}
+
+// reviewRules is a helper function to get the Permissions in the namespace, or at the cluster level
+// when it is empty, from a SelfSubjectRulesReview. It returns an error if the rules can't be reviewed.
+func (a *SubjectAccessReviewAuthorizer) reviewRules(ctx context.Context, namespace string) (rbac.Permissions, error) {
+	review := &authorizationv1.SelfSubjectRulesReview{
+		Spec: authorizationv1.SelfSubjectRulesReviewSpec{Namespace: namespace},
+	}
+	if err := a.selfClient.Create(ctx, review); err != nil {
+		return nil, fmt.Errorf("encountered an error creating a SelfSubjectRulesReview: %w", err)
+	}
+
+	if review.Status.Incomplete {
+		klog.V(0).Infof("the rules for namespace `%s` are incomplete: %s", namespace, review.Status.EvaluationError)
+	}
+
+	return rbac.PermissionsForResourceRules(namespace, review.Status.ResourceRules), nil
+}
+
+// Subscribe registers a new subscriber that is notified every time the discovered permissions
+// expire. The returned function must be called to cancel the subscription.
+func (a *SubjectAccessReviewAuthorizer) Subscribe() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(a.ttl)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				select {
+				case ch <- struct{}{}:
+				default: // the subscriber has not read the previous notification yet
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() { close(stop) })
+	}
+}
+
+// identityAuthorizer is the SubjectAccessReviewAuthorizer of an identity
+type identityAuthorizer struct {
+	// The SubjectAccessReviewAuthorizer
+	authorizer *SubjectAccessReviewAuthorizer
+	// The last time that the SubjectAccessReviewAuthorizer was requested
+	lastUsed time.Time
+}
+
+// SubjectAccessReviewIdentityAuthorizers are the SubjectAccessReviewAuthorizers of each identity
+// that requests are made as. The SubjectAccessReviews are created with the identity of the shared
+// Clients and the SelfSubjectRulesReviews are created with Clients that impersonate the identity.
+// The SubjectAccessReviewAuthorizer of an identity is removed once it has not been requested for
+// the idle timeout.
+type SubjectAccessReviewIdentityAuthorizers struct {
+	// The shared Clients
+	clients *Clients
+	// How long decisions and discovered permissions are cached
+	ttl time.Duration
+	// How long a SubjectAccessReviewAuthorizer is kept after it was last requested
+	idleTimeout time.Duration
+
+	// The lock for the authorizers
+	mu sync.Mutex
+	// The SubjectAccessReviewAuthorizers keyed by the impersonation key of their identity
+	authorizers map[string]*identityAuthorizer
+}
+
+// NewSubjectAccessReviewIdentityAuthorizers creates new SubjectAccessReviewIdentityAuthorizers that use
+// the given Clients, cache decisions for the given TTL and remove the SubjectAccessReviewAuthorizers
+// that have not been requested for the given idle timeout
+func NewSubjectAccessReviewIdentityAuthorizers(clients *Clients, ttl time.Duration, idleTimeout time.Duration) *SubjectAccessReviewIdentityAuthorizers {
+	return &SubjectAccessReviewIdentityAuthorizers{
+		clients:     clients,
+		ttl:         ttl,
+		idleTimeout: idleTimeout,
+		authorizers: map[string]*identityAuthorizer{},
+	}
+}
+
+// HasSynced always returns true, the SubjectAccessReviewIdentityAuthorizers do not have to sync
+func (a *SubjectAccessReviewIdentityAuthorizers) HasSynced() bool {
+	return true
+}
+
+// AuthorizerFor returns the SubjectAccessReviewAuthorizer for the given rbac.Identity
+func (a *SubjectAccessReviewIdentityAuthorizers) AuthorizerFor(ctx context.Context, identity rbac.Identity) (Authorizer, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Authorizers that are idle are removed whenever an authorizer is requested
+	now := time.Now()
+	for key, ia := range a.authorizers {
+		if now.Sub(ia.lastUsed) > a.idleTimeout {
+			delete(a.authorizers, key)
+		}
+	}
+
+	// The decisions are made with the extra information of the identity, so it is part of the key
+	key := identity.ImpersonationKey()
+	if ia, ok := a.authorizers[key]; ok {
+		ia.lastUsed = now
+		return ia.authorizer, nil
+	}
+
+	impersonating, err := a.clients.Impersonating(identity)
+	if err != nil {
+		return nil, err
+	}
+
+	authorizer := NewSubjectAccessReviewAuthorizer(a.clients.Client, impersonating.Client, identity, a.ttl)
+	a.authorizers[key] = &identityAuthorizer{authorizer: authorizer, lastUsed: now}
+	return authorizer, nil
+}
@@ -0,0 +1,197 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// rulesReviewClient is a client.Client that answers SelfSubjectRulesReviews
+// with fixed rules per namespace, or fails them with a fixed error per
+// namespace, and records the namespaces that were reviewed. Reviews wait
+// for the release channel to be closed when one is set.
+type rulesReviewClient struct {
+	client.Client
+	rules   map[string][]authorizationv1.ResourceRule
+	release chan struct{}
+
+	mu       sync.Mutex
+	errs     map[string]error
+	reviewed []string
+}
+
+func (c *rulesReviewClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	review, ok := obj.(*authorizationv1.SelfSubjectRulesReview)
+	if !ok {
+		return c.Client.Create(ctx, obj, opts...)
+	}
+
+	if c.release != nil {
+		<-c.release
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reviewed = append(c.reviewed, review.Spec.Namespace)
+	if err := c.errs[review.Spec.Namespace]; err != nil {
+		return err
+	}
+	review.Status.ResourceRules = c.rules[review.Spec.Namespace]
+	return nil
+}
+
+// setError sets the error that the reviews of the namespace fail with
+func (c *rulesReviewClient) setError(namespace string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errs[namespace] = err
+}
+
+// reviewedNamespaces returns the namespaces that were reviewed
+func (c *rulesReviewClient) reviewedNamespaces() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.reviewed...)
+}
+
+func TestSubjectAccessReviewAuthorizerPermittedNames(t *testing.T) {
+	cli := &rulesReviewClient{
+		Client: fake.NewClientBuilder().Build(),
+		errs:   map[string]error{},
+		rules: map[string][]authorizationv1.ResourceRule{
+			"": {
+				{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"pods"}, ResourceNames: []string{"cluster-pod"}},
+			},
+			"default": {
+				{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"pods"}, ResourceNames: []string{"my-pod"}},
+			},
+			"other": {
+				{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"pods"}, ResourceNames: []string{"other-pod"}},
+			},
+		},
+	}
+	authz := NewSelfSubjectAccessReviewAuthorizer(cli, time.Minute)
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+
+	names, err := authz.ForRequest().PermittedNames(context.Background(), gvr, "default", "get")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{"cluster-pod", "my-pod"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("expected names %v, got %v", want, names)
+	}
+
+	// the rules are cached, so a second request does not review them again
+	if _, err := authz.ForRequest().PermittedNames(context.Background(), gvr, "default", "get"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{"", "default"}; !reflect.DeepEqual(cli.reviewedNamespaces(), want) {
+		t.Fatalf("expected only the namespaces %q to be reviewed, got %q", want, cli.reviewedNamespaces())
+	}
+}
+
+func TestSubjectAccessReviewAuthorizerPermissionsFailedNamespaces(t *testing.T) {
+	podRules := []authorizationv1.ResourceRule{{Verbs: []string{"list"}, APIGroups: []string{""}, Resources: []string{"pods"}}}
+	cli := &rulesReviewClient{
+		Client: fake.NewClientBuilder().WithObjects(
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "other"}},
+		).Build(),
+		errs:  map[string]error{"other": apierrors.NewServiceUnavailable("unavailable")},
+		rules: map[string][]authorizationv1.ResourceRule{"default": podRules, "other": podRules},
+	}
+	authz := NewSelfSubjectAccessReviewAuthorizer(cli, time.Minute)
+
+	perms, err := authz.ForRequest().Permissions(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := perms.NamespacePermissions["default"]; !ok {
+		t.Fatalf("expected the permissions of namespace default, got %v", perms.NamespacePermissions)
+	}
+	if _, ok := perms.NamespacePermissions["other"]; ok {
+		t.Fatalf("expected no permissions of the failed namespace other, got %v", perms.NamespacePermissions)
+	}
+	if err := perms.FailedNamespaces["other"]; !apierrors.IsServiceUnavailable(err) {
+		t.Fatalf("expected namespace other to have failed as unavailable, got %v", perms.FailedNamespaces)
+	}
+
+	// neither the failed review nor the incomplete permissions are cached, so the namespace is
+	// reviewed again and the permissions are complete once the review succeeds
+	cli.setError("other", nil)
+	perms, err = authz.ForRequest().Permissions(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(perms.FailedNamespaces) != 0 {
+		t.Fatalf("expected no failed namespaces, got %v", perms.FailedNamespaces)
+	}
+	if _, ok := perms.NamespacePermissions["other"]; !ok {
+		t.Fatalf("expected the permissions of namespace other, got %v", perms.NamespacePermissions)
+	}
+
+	reviewed := 0
+	for _, namespace := range cli.reviewedNamespaces() {
+		if namespace == "other" {
+			reviewed++
+		}
+	}
+	if reviewed != 2 {
+		t.Fatalf("expected namespace other to be reviewed twice, got %d", reviewed)
+	}
+}
+
+func TestSubjectAccessReviewAuthorizerSharesReviews(t *testing.T) {
+	cli := &rulesReviewClient{
+		Client:  fake.NewClientBuilder().Build(),
+		errs:    map[string]error{},
+		release: make(chan struct{}),
+		rules: map[string][]authorizationv1.ResourceRule{
+			"": {{Verbs: []string{"get"}, APIGroups: []string{""}, Resources: []string{"pods"}, ResourceNames: []string{"my-pod"}}},
+		},
+	}
+	authz := NewSelfSubjectAccessReviewAuthorizer(cli, time.Minute)
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+
+	// the first caller gives up while the review is in flight
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error, 1)
+	go func() {
+		_, err := authz.ForRequest().PermittedNames(ctx, gvr, "", "get")
+		cancelled <- err
+	}()
+
+	names := make(chan []string, 1)
+	go func() {
+		n, err := authz.ForRequest().PermittedNames(context.Background(), gvr, "", "get")
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		names <- n
+	}()
+
+	cancel()
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the cancelled caller to fail with %v, got %v", context.Canceled, err)
+	}
+
+	// the cancelled caller doesn't fail the review that the other caller waits for
+	close(cli.release)
+	if want := []string{"my-pod"}; !reflect.DeepEqual(<-names, want) {
+		t.Fatalf("expected names %v", want)
+	}
+	if want := []string{""}; !reflect.DeepEqual(cli.reviewedNamespaces(), want) {
+		t.Fatalf("expected the namespaces %q to be reviewed once, got %q", want, cli.reviewedNamespaces())
+	}
+}
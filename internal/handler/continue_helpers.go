@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// listContinue is the position that a paginated merged list continues from.
+// It is encoded into an opaque continue token that is returned to the client.
+type listContinue struct {
+	// The namespace to continue listing from
+	Namespace string `json:"ns"`
+	// The continue token of the upstream list request for the namespace
+	Continue string `json:"c,omitempty"`
+	// The resource name to continue from for namespaces where only specific resource names are permitted
+	Name string `json:"n,omitempty"`
+	// The resourceVersion that every namespace of the list is listed at,
+	// empty if the pages before only fetched resources by name
+	ResourceVersion string `json:"rv,omitempty"`
+}
+
+// encodeContinue is a helper function to encode a listContinue
+// into an opaque continue token
+func encodeContinue(c listContinue) (string, error) {
+	raw, err := json.Marshal(c)
+	if err != nil {
+		return "", fmt.Errorf("encountered an error encoding continue token: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// decodeContinue is a helper function to decode an opaque
+// continue token into a listContinue
+func decodeContinue(token string) (listContinue, error) {
+	c := listContinue{}
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return c, fmt.Errorf("continue token is not valid: %w", err)
+	}
+
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return c, fmt.Errorf("continue token is not valid: %w", err)
+	}
+
+	if c.Namespace == "" {
+		return c, fmt.Errorf("continue token is not valid: missing namespace")
+	}
+
+	return c, nil
+}
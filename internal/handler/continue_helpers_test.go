@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestContinueRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		c    listContinue
+	}{
+		{name: "namespace only", c: listContinue{Namespace: "default"}},
+		{name: "upstream continue", c: listContinue{Namespace: "default", Continue: "upstream", ResourceVersion: "100"}},
+		{name: "resource name", c: listContinue{Namespace: "default", Name: "my-pod", ResourceVersion: "100"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := encodeContinue(tt.c)
+			if err != nil {
+				t.Fatalf("unexpected error encoding continue token: %v", err)
+			}
+
+			decoded, err := decodeContinue(token)
+			if err != nil {
+				t.Fatalf("unexpected error decoding continue token: %v", err)
+			}
+			if decoded != tt.c {
+				t.Fatalf("expected %+v, got %+v", tt.c, decoded)
+			}
+		})
+	}
+}
+
+func TestDecodeContinueInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{name: "not base64", token: "not a token!"},
+		{name: "not json", token: base64.RawURLEncoding.EncodeToString([]byte("not json"))},
+		{name: "missing namespace", token: base64.RawURLEncoding.EncodeToString([]byte(`{"c":"upstream"}`))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeContinue(tt.token); err == nil {
+				t.Fatalf("expected an error decoding continue token %q", tt.token)
+			}
+		})
+	}
+}
@@ -0,0 +1,542 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer/protobuf"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// listFormat is the format that a merged list is returned to the client in
+type listFormat int
+
+const (
+	// formatList returns the resources as a list of the resource Kind
+	formatList listFormat = iota
+	// formatTable returns the resources as the rows of a meta.k8s.io Table
+	formatTable
+	// formatMetadata returns the metadata of the resources as a meta.k8s.io PartialObjectMetadataList
+	formatMetadata
+)
+
+const (
+	// protobufMediaType is the media type of the Kubernetes protobuf encoding
+	protobufMediaType = "application/vnd.kubernetes.protobuf"
+	// tableAccept is the Accept header used to request a Table from the Kubernetes API
+	tableAccept = "application/json;as=Table;v=v1;g=meta.k8s.io"
+	// metadataListAccept is the Accept header used to request a PartialObjectMetadataList from the Kubernetes API
+	metadataListAccept = "application/json;as=PartialObjectMetadataList;v=v1;g=meta.k8s.io"
+	// metadataAccept is the Accept header used to request a PartialObjectMetadata from the Kubernetes API
+	metadataAccept = "application/json;as=PartialObjectMetadata;v=v1;g=meta.k8s.io"
+)
+
+// protobufPrefix is the prefix of every object that is encoded with the Kubernetes protobuf encoding
+var protobufPrefix = []byte{0x6b, 0x38, 0x73, 0x00}
+
+// protobufScheme is the runtime.Scheme of the types that can be encoded as protobuf
+var protobufScheme = newProtobufScheme()
+
+// protobufSerializer is the serializer used to encode responses as protobuf
+var protobufSerializer = protobuf.NewSerializer(protobufScheme, protobufScheme)
+
+// newProtobufScheme is a helper function to create a runtime.Scheme with
+// the built-in Kubernetes types and the meta.k8s.io types
+func newProtobufScheme() *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(metav1.AddMetaToScheme(scheme))
+	return scheme
+}
+
+// negotiateFormat is a helper function to get the listFormat that the client asked
+// for in the Accept header of the request and whether or not the client asked for
+// protobuf. The media types of the Accept header are considered in order and the
+// first one that is supported is used. Protobuf is only supported when the response
+// for the resources of the given GVK can be encoded as protobuf. It returns formatList
+// as JSON if the request has no Accept header and an error if none of the media types
+// are supported.
+func negotiateFormat(req *http.Request, gvk schema.GroupVersionKind) (listFormat, bool, error) {
+	accept := req.Header.Get("Accept")
+	if strings.TrimSpace(accept) == "" {
+		return formatList, false, nil
+	}
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		protobuf := false
+		switch mediaType {
+		case "application/json", "application/*", "*/*":
+		case protobufMediaType:
+			protobuf = true
+		default:
+			continue
+		}
+
+		format := formatList
+		switch params["as"] {
+		case "":
+		case "Table":
+			if params["g"] != metav1.GroupName || params["v"] != "v1" {
+				continue
+			}
+			format = formatTable
+		case "PartialObjectMetadataList":
+			if params["g"] != metav1.GroupName || params["v"] != "v1" {
+				continue
+			}
+			format = formatMetadata
+		default:
+			continue
+		}
+
+		if protobuf && !supportsProtobuf(format, gvk) {
+			continue
+		}
+		return format, protobuf, nil
+	}
+
+	return formatList, false, &apierrors.StatusError{ErrStatus: metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    http.StatusNotAcceptable,
+		Reason:  metav1.StatusReasonNotAcceptable,
+		Message: fmt.Sprintf("only the following media types are accepted: application/json, %s", protobufMediaType),
+	}}
+}
+
+// supportsProtobuf is a helper function to determine if the response of the given listFormat
+// for the resources of the GVK can be encoded as protobuf. Tables and the types that are not
+// built into Kubernetes, such as custom resources, can't be. Returns a bool that is true if
+// the response can be encoded as protobuf and false if it can not
+func supportsProtobuf(format listFormat, gvk schema.GroupVersionKind) bool {
+	var listGVK schema.GroupVersionKind
+	switch format {
+	case formatTable:
+		listGVK = metav1.SchemeGroupVersion.WithKind("Table")
+	case formatMetadata:
+		listGVK = metav1.SchemeGroupVersion.WithKind("PartialObjectMetadataList")
+	default:
+		listGVK = gvk.GroupVersion().WithKind(getKindList(gvk.Kind))
+	}
+
+	obj, err := protobufScheme.New(listGVK)
+	if err != nil {
+		return false
+	}
+
+	_, ok := obj.(interface{ Marshal() ([]byte, error) })
+	return ok
+}
+
+// decodeDeleteOptions is a helper function to decode the body of a request with the given
+// Content-Type into the metav1.DeleteOptions. A body without a Content-Type is decoded as
+// JSON. Like the Kubernetes API, the group and version of the kind of the body are ignored,
+// so the delete options of any API group can be decoded. It returns a BadRequest error if
+// the body can't be decoded and an UnsupportedMediaType error if the Content-Type is neither
+// JSON nor protobuf.
+func decodeDeleteOptions(contentType string, body []byte, opts *metav1.DeleteOptions) error {
+	mediaType := "application/json"
+	if strings.TrimSpace(contentType) != "" {
+		parsed, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return apierrors.NewBadRequest(fmt.Sprintf("encountered an error parsing the Content-Type `%s`: %v", contentType, err))
+		}
+		mediaType = parsed
+	}
+
+	switch mediaType {
+	case "application/json":
+		if err := json.Unmarshal(body, opts); err != nil {
+			return apierrors.NewBadRequest(fmt.Sprintf("encountered an error parsing delete options: %v", err))
+		}
+		return nil
+	case protobufMediaType:
+		if !bytes.HasPrefix(body, protobufPrefix) {
+			return apierrors.NewBadRequest("encountered an error parsing delete options: the body is not encoded as protobuf")
+		}
+		unknown := &runtime.Unknown{}
+		if err := unknown.Unmarshal(body[len(protobufPrefix):]); err != nil {
+			return apierrors.NewBadRequest(fmt.Sprintf("encountered an error parsing delete options: %v", err))
+		}
+		if err := opts.Unmarshal(unknown.Raw); err != nil {
+			return apierrors.NewBadRequest(fmt.Sprintf("encountered an error parsing delete options: %v", err))
+		}
+		return nil
+	}
+
+	return &apierrors.StatusError{ErrStatus: metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    http.StatusUnsupportedMediaType,
+		Reason:  metav1.StatusReasonUnsupportedMediaType,
+		Message: fmt.Sprintf("only the following media types are supported for delete options: application/json, %s", protobufMediaType),
+	}}
+}
+
+// encodeProtobuf is a helper function to encode an object as protobuf. The object is
+// converted to its type in the protobufScheme before it is encoded. It returns the encoded
+// object and an error if the type of the object is not known or does not support protobuf.
+func encodeProtobuf(obj runtime.Unstructured) ([]byte, error) {
+	gvk := obj.GetObjectKind().GroupVersionKind()
+	typed, err := protobufScheme.New(gvk)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.UnstructuredContent(), typed); err != nil {
+		return nil, fmt.Errorf("encountered an error converting %s: %w", gvk, err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := protobufSerializer.Encode(typed, buf); err != nil {
+		return nil, fmt.Errorf("encountered an error encoding %s as protobuf: %w", gvk, err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// newRESTClient is a helper function to create a rest.Interface for the given
+// rest.Config that can make requests for arbitrary paths of the Kubernetes API
+func newRESTClient(cfg *rest.Config) (rest.Interface, error) {
+	cfg = rest.CopyConfig(cfg)
+	cfg.NegotiatedSerializer = clientgoscheme.Codecs.WithoutConversion()
+
+	restClient, err := rest.UnversionedRESTClientFor(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("encountered an error creating a new REST client: %w", err)
+	}
+
+	return restClient, nil
+}
+
+// resourceLister lists and gets the resources of a GVK in a listFormat.
+// Resources are represented as unstructured.Unstructured regardless of the
+// format, with each row of a Table being represented as its own resource.
+type resourceLister struct {
+	// The client used to list and get the resources as the resource Kind
+	cli client.Client
+	// The client used to list and get the resources in any other format
+	restClient rest.Interface
+	// The GVK of the resources
+	gvk schema.GroupVersionKind
+	// The GVR of the resources
+	gvr schema.GroupVersionResource
+	// The format to list and get the resources in
+	format listFormat
+	// Whether or not the merged resources are written as protobuf when the type supports it
+	protobuf bool
+	// The includeObject table option requested by the client
+	includeObject string
+
+	// The lock for the column definitions
+	mu sync.Mutex
+	// The column definitions of the Table, set from the first Table that is listed
+	columns []interface{}
+}
+
+// newResourceLister creates a new resourceLister for the given GVK and listFormat. The rest.Interface
+// is only used for formats other than formatList and the includeObject table option is forwarded
+// to the Kubernetes API when listing a Table. When protobuf is true the merged resources are written
+// as protobuf if their type supports it. It returns an error if the resource for the GVK can not
+// be resolved.
+func newResourceLister(cli client.Client, restClient rest.Interface, gvk schema.GroupVersionKind, format listFormat, protobuf bool, includeObject string) (*resourceLister, error) {
+	gvr, err := getResourceForKind(cli.RESTMapper(), gvk)
+	if err != nil {
+		return nil, err
+	}
+
+	return &resourceLister{
+		cli:           cli,
+		restClient:    restClient,
+		gvk:           gvk,
+		gvr:           gvr,
+		format:        format,
+		protobuf:      protobuf,
+		includeObject: includeObject,
+	}, nil
+}
+
+// listGVK is a helper function to get the GVK of the lists of the resourceLister
+func (l *resourceLister) listGVK() schema.GroupVersionKind {
+	if l.format == formatMetadata {
+		return metav1.SchemeGroupVersion.WithKind("PartialObjectMetadataList")
+	}
+
+	return schema.GroupVersionKind{
+		Group:   l.gvk.Group,
+		Version: l.gvk.Version,
+		Kind:    getKindList(l.gvk.Kind),
+	}
+}
+
+// newList is a helper function to create an empty unstructured.UnstructuredList
+// for the resources of the resourceLister
+func (l *resourceLister) newList() *unstructured.UnstructuredList {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(l.listGVK())
+	return list
+}
+
+// list lists a page of the resources in a namespace with the given client.ListOptions.
+// It returns an unstructured.UnstructuredList and an error if the list failed.
+func (l *resourceLister) list(ctx context.Context, namespace string, opts *client.ListOptions) (*unstructured.UnstructuredList, error) {
+	if l.format == formatList {
+		list := l.newList()
+		if err := l.cli.List(ctx, list, opts); err != nil {
+			return nil, err
+		}
+		return list, nil
+	}
+
+	raw := metav1.ListOptions{}
+	if opts.Raw != nil {
+		raw = *opts.Raw
+	}
+	raw.Limit = opts.Limit
+	raw.Continue = opts.Continue
+
+	req := l.restClient.Get().
+		AbsPath(resourcePath(l.gvr, namespace, "")).
+		SpecificallyVersionedParams(&raw, metav1.ParameterCodec, metav1.SchemeGroupVersion)
+
+	if l.format == formatMetadata {
+		body, err := doRequest(ctx, req.SetHeader("Accept", metadataListAccept))
+		if err != nil {
+			return nil, err
+		}
+
+		list := l.newList()
+		if err := list.UnmarshalJSON(body); err != nil {
+			return nil, fmt.Errorf("encountered an error decoding PartialObjectMetadataList: %w", err)
+		}
+		return list, nil
+	}
+
+	if l.includeObject != "" {
+		req = req.Param("includeObject", l.includeObject)
+	}
+	body, err := doRequest(ctx, req.SetHeader("Accept", tableAccept))
+	if err != nil {
+		return nil, err
+	}
+	return l.decodeTable(body)
+}
+
+// get gets the resource with the given name in a namespace. For formatTable the resource is
+// the row of the Table of the resource. It returns an unstructured.Unstructured and an error
+// if the get failed.
+func (l *resourceLister) get(ctx context.Context, namespace string, name string) (*unstructured.Unstructured, error) {
+	if l.format == formatList {
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(l.gvk)
+		if err := l.cli.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, obj); err != nil {
+			return nil, err
+		}
+		return obj, nil
+	}
+
+	req := l.restClient.Get().AbsPath(resourcePath(l.gvr, namespace, name))
+
+	if l.format == formatMetadata {
+		body, err := doRequest(ctx, req.SetHeader("Accept", metadataAccept))
+		if err != nil {
+			return nil, err
+		}
+
+		obj := &unstructured.Unstructured{}
+		if err := obj.UnmarshalJSON(body); err != nil {
+			return nil, fmt.Errorf("encountered an error decoding PartialObjectMetadata: %w", err)
+		}
+		return obj, nil
+	}
+
+	if l.includeObject != "" {
+		req = req.Param("includeObject", l.includeObject)
+	}
+	body, err := doRequest(ctx, req.SetHeader("Accept", tableAccept))
+	if err != nil {
+		return nil, err
+	}
+
+	table, err := l.decodeTable(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(table.Items) != 1 {
+		return nil, fmt.Errorf("expected a Table with one row for %s `%s` but got %d rows", l.gvk.Kind, name, len(table.Items))
+	}
+	return &table.Items[0], nil
+}
+
+// decodeTable is a helper function to decode a Table into an unstructured.UnstructuredList
+// with an item for each row of the Table. The column definitions of the first Table that
+// is decoded are kept for the merged Table and any Table with different column definitions
+// can not be merged. It returns an unstructured.UnstructuredList and an error if the Table
+// could not be decoded or merged.
+func (l *resourceLister) decodeTable(body []byte) (*unstructured.UnstructuredList, error) {
+	table := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&table); err != nil {
+		return nil, fmt.Errorf("encountered an error decoding Table: %w", err)
+	}
+
+	columns, _, _ := unstructured.NestedSlice(table, "columnDefinitions")
+	if len(columns) > 0 {
+		l.mu.Lock()
+		if l.columns == nil {
+			l.columns = columns
+		}
+		consistent := reflect.DeepEqual(l.columns, columns)
+		l.mu.Unlock()
+
+		if !consistent {
+			return nil, fmt.Errorf("the Table columns of %s do not match the columns of the other namespaces", l.gvr.Resource)
+		}
+	}
+
+	rows, _, _ := unstructured.NestedSlice(table, "rows")
+	delete(table, "rows")
+
+	list := &unstructured.UnstructuredList{Object: table}
+	for _, row := range rows {
+		rowObj, ok := row.(map[string]interface{})
+		if !ok {
+			klog.V(0).Infof("skipping Table row of %s that is not an object", l.gvr.Resource)
+			continue
+		}
+		list.Items = append(list.Items, unstructured.Unstructured{Object: rowObj})
+	}
+
+	return list, nil
+}
+
+// matches is a helper function to determine if a resource of the resourceLister matches
+// the label and field selectors of the metav1.ListOptions. For formatTable the selectors
+// are matched against the object of the row, which has no metadata if the client did not
+// include the object. Returns a bool that is true if the resource matches and false if it does not
+func (l *resourceLister) matches(obj *unstructured.Unstructured, opts metav1.ListOptions) bool {
+	if l.format != formatTable {
+		return matchesSelectors(obj, opts)
+	}
+
+	rowObj, _, _ := unstructured.NestedMap(obj.Object, "object")
+	return matchesSelectors(&unstructured.Unstructured{Object: rowObj}, opts)
+}
+
+// validateFieldSelector is a helper function to determine if the field selector can be evaluated
+// for the resources of the resourceLister that are fetched by name. Only the metadata fields can
+// be evaluated when the resources are fetched as PartialObjectMetadata or as a Table that does not
+// include the object. It returns a BadRequest error if the field selector can't be evaluated.
+func (l *resourceLister) validateFieldSelector(fieldSelector string) error {
+	if fieldSelector == "" {
+		return nil
+	}
+
+	selector, err := fields.ParseSelector(fieldSelector)
+	if err != nil {
+		return apierrors.NewBadRequest(fmt.Sprintf("encountered an error parsing field selector: %v", err))
+	}
+
+	if l.format == formatList || (l.format == formatTable && l.includeObject == string(metav1.IncludeObject)) {
+		return nil
+	}
+
+	for _, req := range selector.Requirements() {
+		if _, ok := metadataFieldSelectors[req.Field]; !ok {
+			return apierrors.NewBadRequest(fmt.Sprintf("the field selector on `%s` can't be evaluated for %s that are not listed as whole objects", req.Field, l.gvr.Resource))
+		}
+	}
+
+	return nil
+}
+
+// write writes the merged resourceList to the http.ResponseWriter in the format of the resourceLister
+func (l *resourceLister) write(rw http.ResponseWriter, resourceList *unstructured.UnstructuredList) {
+	if l.format != formatTable {
+		writeObject(rw, resourceList, l.protobuf)
+		return
+	}
+
+	rows := []interface{}{}
+	for _, item := range resourceList.Items {
+		rows = append(rows, item.Object)
+	}
+
+	l.mu.Lock()
+	columns := l.columns
+	l.mu.Unlock()
+	if columns == nil {
+		columns = []interface{}{}
+	}
+
+	metadata := map[string]interface{}{}
+	if resourceList.GetResourceVersion() != "" {
+		metadata["resourceVersion"] = resourceList.GetResourceVersion()
+	}
+	if resourceList.GetContinue() != "" {
+		metadata["continue"] = resourceList.GetContinue()
+	}
+
+	table := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata":          metadata,
+		"columnDefinitions": columns,
+		"rows":              rows,
+	}}
+	table.SetGroupVersionKind(metav1.SchemeGroupVersion.WithKind("Table"))
+	writeObject(rw, table, l.protobuf)
+}
+
+// doRequest is a helper function to execute a rest.Request and get the raw body of the response.
+// It returns the body and an error that keeps the Status returned by the Kubernetes API, if any.
+func doRequest(ctx context.Context, req *rest.Request) ([]byte, error) {
+	result := req.Do(ctx)
+	body, err := result.Raw()
+	if err != nil {
+		return nil, result.Error()
+	}
+
+	return body, nil
+}
+
+// resourcePath is a helper function to get the path of the Kubernetes API for the resources of
+// a GroupVersionResource in a namespace, or for the resource with the given name if it is not empty.
+// The namespace should be empty for cluster scoped resources.
+func resourcePath(gvr schema.GroupVersionResource, namespace string, name string) string {
+	parts := []string{"/apis", gvr.Group, gvr.Version}
+	if gvr.Group == "" {
+		parts = []string{"/api", gvr.Version}
+	}
+
+	if namespace != "" {
+		parts = append(parts, "namespaces", namespace)
+	}
+	parts = append(parts, gvr.Resource)
+
+	if name != "" {
+		parts = append(parts, name)
+	}
+
+	return path.Join(parts...)
+}
@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestDecodeDeleteOptions(t *testing.T) {
+	propagation := metav1.DeletePropagationForeground
+	grace := int64(5)
+	want := metav1.DeleteOptions{
+		TypeMeta:           metav1.TypeMeta{APIVersion: "v1", Kind: "DeleteOptions"},
+		PropagationPolicy:  &propagation,
+		GracePeriodSeconds: &grace,
+	}
+
+	buf := &bytes.Buffer{}
+	if err := protobufSerializer.Encode(want.DeepCopy(), buf); err != nil {
+		t.Fatalf("unexpected error encoding delete options: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		code        int32
+	}{
+		{name: "json", contentType: "application/json", body: []byte(`{"propagationPolicy":"Foreground","gracePeriodSeconds":5}`)},
+		{name: "json without a content type", body: []byte(`{"propagationPolicy":"Foreground","gracePeriodSeconds":5}`)},
+		{name: "protobuf", contentType: protobufMediaType, body: buf.Bytes()},
+		{name: "json sent as protobuf", contentType: protobufMediaType, body: []byte(`{}`), code: http.StatusBadRequest},
+		{name: "unsupported media type", contentType: "application/xml", body: []byte(`<DeleteOptions/>`), code: http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := metav1.DeleteOptions{}
+			err := decodeDeleteOptions(tt.contentType, tt.body, &opts)
+			if tt.code != 0 {
+				if code := statusForError(err).Code; err == nil || code != tt.code {
+					t.Fatalf("expected a %d error, got %v", tt.code, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if opts.PropagationPolicy == nil || *opts.PropagationPolicy != propagation {
+				t.Fatalf("expected propagation policy %s, got %v", propagation, opts.PropagationPolicy)
+			}
+			if opts.GracePeriodSeconds == nil || *opts.GracePeriodSeconds != grace {
+				t.Fatalf("expected grace period %d, got %v", grace, opts.GracePeriodSeconds)
+			}
+		})
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	pod := schema.GroupVersionKind{Version: "v1", Kind: "Pod"}
+	widget := schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Widget"}
+	tableProtobuf := protobufMediaType + ";as=Table;v=v1;g=meta.k8s.io"
+	metadataProtobuf := protobufMediaType + ";as=PartialObjectMetadataList;v=v1;g=meta.k8s.io"
+
+	tests := []struct {
+		name       string
+		accept     string
+		gvk        schema.GroupVersionKind
+		format     listFormat
+		protobuf   bool
+		acceptable bool
+	}{
+		{name: "no accept", accept: "", gvk: pod, format: formatList, acceptable: true},
+		{name: "json", accept: "application/json", gvk: pod, format: formatList, acceptable: true},
+		{name: "protobuf", accept: protobufMediaType, gvk: pod, format: formatList, protobuf: true, acceptable: true},
+		{name: "metadata protobuf", accept: metadataProtobuf, gvk: widget, format: formatMetadata, protobuf: true, acceptable: true},
+		{name: "table json", accept: tableAccept, gvk: pod, format: formatTable, acceptable: true},
+		{name: "only table protobuf", accept: tableProtobuf, gvk: pod, acceptable: false},
+		{name: "table protobuf before json", accept: tableProtobuf + ", " + tableAccept, gvk: pod, format: formatTable, acceptable: true},
+		{name: "only custom resource protobuf", accept: protobufMediaType, gvk: widget, acceptable: false},
+		{name: "custom resource protobuf before json", accept: protobufMediaType + ", application/json", gvk: widget, format: formatList, acceptable: true},
+		{name: "unsupported", accept: "text/plain", gvk: pod, acceptable: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+			req.Header.Set("Accept", tt.accept)
+
+			format, protobuf, err := negotiateFormat(req, tt.gvk)
+			if !tt.acceptable {
+				if err == nil || statusForError(err).Code != http.StatusNotAcceptable {
+					t.Fatalf("expected a NotAcceptable error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if format != tt.format || protobuf != tt.protobuf {
+				t.Fatalf("expected format %d and protobuf %t, got format %d and protobuf %t", tt.format, tt.protobuf, format, protobuf)
+			}
+		})
+	}
+}
@@ -1,92 +1,332 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/everettraven/rbac-proxy-poc/internal/rbac"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/flowcontrol"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/client/config"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
 )
 
+// notReadyRetryAfterSeconds is the number of seconds a client should wait before
+// retrying a request that was received before the RBAC permissions have synced
+const notReadyRetryAfterSeconds = 1
+
+// PartialFailurePolicy is how a cluster level list that is faked
+// responds when some of its namespaces can not be listed
+type PartialFailurePolicy string
+
+const (
+	// PartialFailurePolicyFail fails the whole request with a Status that aggregates the failures
+	PartialFailurePolicyFail PartialFailurePolicy = "Fail"
+	// PartialFailurePolicyWarn returns the partial list with a Warning header for each failed namespace
+	PartialFailurePolicyWarn PartialFailurePolicy = "Warn"
+)
+
+// Options are the options for handling proxy requests
+type Options struct {
+	// The maximum number of namespaces that are listed or deleted from concurrently when a cluster level request is faked
+	MaxConcurrentLists int
+	// The maximum amount of time that faking a cluster level list or deletecollection may take, zero for no deadline
+	ListTimeout time.Duration
+	// How a cluster level list that is faked responds when some of its namespaces can not be listed
+	PartialFailurePolicy PartialFailurePolicy
+}
+
+// Clients are the long-lived clients that are shared by every proxy request
+type Clients struct {
+	// The client used to list, get and watch resources as the resource Kind
+	Client client.WithWatch
+	// The client used to list and get resources in any other format
+	RESTClient rest.Interface
+	// The cache that merged lists are served from when possible, nil if lists are not cached
+	Cache *ReadCache
+	// How long the Clients that impersonate an identity are kept after they were last requested
+	ImpersonationIdleTimeout time.Duration
+
+	// The rest.Config the clients were created for
+	cfg *rest.Config
+	// The RESTMapper shared by the clients
+	mapper meta.RESTMapper
+	// The Clients that impersonate an identity keyed by the impersonation key of the identity
+	impersonating map[string]*impersonatingClients
+	// The lock for the impersonating Clients
+	impersonatingMu sync.Mutex
+}
+
+// impersonatingClients are the Clients that impersonate an identity
+type impersonatingClients struct {
+	// The Clients
+	clients *Clients
+	// The last time that the Clients were requested
+	lastUsed time.Time
+}
+
+// NewClients creates the Clients for the given rest.Config. Every client shares
+// one rate limiter and, because they are created from the same rest.Config, the
+// connection pool of the transport that client-go caches for the rest.Config.
+// It returns an error if any of the clients could not be created.
+func NewClients(cfg *rest.Config) (*Clients, error) {
+	cfg = rest.CopyConfig(cfg)
+	if cfg.RateLimiter == nil && cfg.QPS > 0 {
+		cfg.RateLimiter = flowcontrol.NewTokenBucketRateLimiter(cfg.QPS, cfg.Burst)
+	}
+
+	mapper, err := apiutil.NewDynamicRESTMapper(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("encountered an error creating a new RESTMapper: %w", err)
+	}
+
+	return newClients(cfg, mapper)
+}
+
+// Impersonating returns Clients that make every request as the given rbac.Identity
+// using the Kubernetes impersonation headers. The returned Clients share the RESTMapper,
+// rate limiter and ReadCache of the Clients and are kept for subsequent requests of the
+// same identity until they have not been requested for the ImpersonationIdleTimeout. The
+// ReadCache is filled using the identity of the Clients, but only the namespaces that the
+// impersonated identity can both list and watch are served from it.
+func (c *Clients) Impersonating(identity rbac.Identity) (*Clients, error) {
+	c.impersonatingMu.Lock()
+	defer c.impersonatingMu.Unlock()
+
+	// Clients that are idle are removed whenever Clients are requested
+	now := time.Now()
+	for key, ic := range c.impersonating {
+		if now.Sub(ic.lastUsed) > c.ImpersonationIdleTimeout {
+			delete(c.impersonating, key)
+		}
+	}
+
+	key := identity.ImpersonationKey()
+	if ic, ok := c.impersonating[key]; ok {
+		ic.lastUsed = now
+		return ic.clients, nil
+	}
+
+	cfg := rest.CopyConfig(c.cfg)
+	cfg.Impersonate = rest.ImpersonationConfig{
+		UserName: identity.User,
+		Groups:   identity.Groups,
+		Extra:    identity.Extra,
+	}
+
+	clients, err := newClients(cfg, c.mapper)
+	if err != nil {
+		return nil, err
+	}
+	clients.Cache = c.Cache
+
+	if c.impersonating == nil {
+		c.impersonating = map[string]*impersonatingClients{}
+	}
+	c.impersonating[key] = &impersonatingClients{clients: clients, lastUsed: now}
+	return clients, nil
+}
+
+// newClients is a helper function to create the Clients for the given rest.Config using the given RESTMapper
+func newClients(cfg *rest.Config, mapper meta.RESTMapper) (*Clients, error) {
+	cli, err := client.NewWithWatch(cfg, client.Options{Mapper: mapper})
+	if err != nil {
+		return nil, fmt.Errorf("encountered an error creating a new controller-runtime client: %w", err)
+	}
+
+	restClient, err := newRESTClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Clients{
+		Client:     cli,
+		RESTClient: restClient,
+		cfg:        cfg,
+		mapper:     mapper,
+	}, nil
+}
+
 // HandleRequest will handle the processing of a proxy request. It accepts a http.ResponseWriter,
-// http.Request, and an RBACWatcher. It will return a bool that represents whether or not the request
+// http.Request, the Authorizer of the caller, the shared Clients, and the Options for handling the request. It will return a bool that represents whether or not the request
 // should continue to be proxied directly to the Kubernetes API server. It returns true if the request
 // should continue and false if the request has been handled.
 // This function handles the following scenarios:
 // 1. A request for a specific resource - continue to proxy to Kubernetes API
-// 2. A request to list/watch resources in a specific namespace - continue to proxy to Kubernetes API
+// 2. A request to list/watch resources in a specific namespace (has permissions) - continue to proxy to Kubernetes API
 // 3. A request to list resources at the cluster level (has permissions) - continue to proxy to Kubernetes API
 // 4. A request to list resources at the cluster level (does NOT have permissions) - handle the request and do NOT continue to proxy
-// TODO: 5. A request to watch resources at the cluster level (has permissions) - continue to proxy to Kubernetes API
-// TODO: 6. A request to watch resources at the cluster level (does NOT have permissions) - handle the request and do NOT continue to proxy
-func HandleRequest(rw http.ResponseWriter, req *http.Request, rbac *rbac.RBACWatcher) bool {
+// 5. A request to watch resources at the cluster level (has permissions) - continue to proxy to Kubernetes API
+// 6. A request to watch resources at the cluster level (does NOT have permissions) - handle the request and do NOT continue to proxy
+// 7. A request to list resources that are only permitted for specific resource names - handle the request and do NOT continue to proxy
+// 8. A request to delete a collection of resources at the cluster level (has permissions) - continue to proxy to Kubernetes API
+// 9. A request to delete a collection of resources at the cluster level (does NOT have permissions) - handle the request and do NOT continue to proxy
+func HandleRequest(rw http.ResponseWriter, req *http.Request, authz Authorizer, clients *Clients, options Options) bool {
 	direct := false
+	cli := clients.Client
 
-	// create a client
-	cli, err := client.New(config.GetConfigOrDie(), client.Options{})
-	if err != nil {
-		klog.V(0).ErrorS(err, "encountered an error creating a new controller-runtime client")
-		return direct
-	}
-
-	// For now just test the ability to stream responses when we recieve a watch request
-	// TODO: implement this for real
-	if isWatchRequest(req.URL) {
-		for i := 0; i < 5; i++ {
-			rw.Write([]byte(fmt.Sprintf("Hello #%d\n", i)))
-			if f, ok := rw.(http.Flusher); ok {
-				f.Flush()
-			}
-			time.Sleep(1 * time.Second)
-		}
-
-		return direct
-	}
+	// evaluate the whole request against a single consistent view of the permissions
+	requestAuthz := authz.ForRequest()
 
 	if isSpecificRequest(req.URL) { // if a specific request proxy directly to the kube api
 		direct = true
 	} else {
-		if isClusterScopedRequest(req.URL) {
-			if isListRequest(req.URL) {
-				gvk := gvkFromURL(req.URL)
-				// lowercase and pluralized Kind represents the resource
-				resource := strings.ToLower(gvk.Kind) + "s"
-				if _, ok := rbac.ClusterPermissions[resource]; ok { // has some form of cluster permissions for the resource
-					if _, ok := rbac.ClusterPermissions[resource]["*"]; ok { // has all permissions for the resource
-						direct = true
-					} else if _, ok := rbac.ClusterPermissions[resource]["list"]; ok { // has cluster list permissions for the resource
-						direct = true
-					} else { // time to fake the cluster request
-						resourceList := getNamespacedResourceList(cli, gvk, rbac.NamespacePermissions, "list")
-						respJson, err := json.Marshal(resourceList)
-						if err != nil {
-							klog.V(0).ErrorS(err, fmt.Sprintf("encountered an error marshalling json for %s", resourceList.GetKind()))
-						}
+		if isClusterScopedRequest(req.URL, cli.RESTMapper()) {
+			gvk, err := gvkFromURL(req.URL, cli.RESTMapper())
+			if err != nil {
+				klog.V(0).ErrorS(err, "encountered an error getting the GVK for request")
+				return true
+			}
+			gvr := gvrFromURL(req.URL)
 
-						rw.Header().Add("Content-Type", "application/json")
-						_, err = rw.Write(respJson)
-						if err != nil {
-							klog.V(0).ErrorS(err, "encountered an error writing JSON to client")
-						}
-					}
+			verb := ""
+			if isWatchRequest(req.URL) {
+				verb = "watch"
+			} else if isDeleteCollectionRequest(req) {
+				verb = "deletecollection"
+			} else if req.Method == http.MethodGet && isListRequest(req.URL) {
+				verb = "list"
+			}
+
+			if verb == "" { // i.e. a create of a namespaced resource at the cluster level, left to the Kubernetes API
+				return true
+			}
+
+			allowed, err := requestAuthz.Authorize(req.Context(), gvr, "", verb)
+			if err != nil {
+				writeStatus(rw, statusForError(err))
+				return direct
+			}
+
+			if verb == "watch" {
+				if allowed { // has cluster watch permissions for the resource
+					direct = true
+				} else { // time to fake the cluster watch
+					watchNamespacedResources(rw, req, cli, gvk, authz, requestAuthz, "watch")
+				}
+			} else if verb == "deletecollection" {
+				if allowed { // has cluster deletecollection permissions for the resource
+					direct = true
+				} else { // time to fan out the delete to the permitted namespaces
+					deleteNamespacedCollection(rw, req, cli, gvk, requestAuthz, options)
+				}
+			} else {
+				if allowed { // has cluster list permissions for the resource
+					direct = true
 				} else { // time to fake the cluster request
-					resourceList := getNamespacedResourceList(cli, gvk, rbac.NamespacePermissions, "list")
-					respJson, err := json.Marshal(resourceList)
+					opts, err := listOptionsFromRequest(req.URL)
+					if err != nil {
+						writeStatus(rw, &apierrors.NewBadRequest(err.Error()).ErrStatus)
+						return direct
+					}
+
+					// client disconnects and the deadline cancel the lists that are in flight
+					var ctx context.Context
+					var cancel context.CancelFunc
+					if options.ListTimeout > 0 {
+						ctx, cancel = context.WithTimeout(req.Context(), options.ListTimeout)
+					} else {
+						ctx, cancel = context.WithCancel(req.Context())
+					}
+					defer cancel()
+
+					lister, err := newResourceListerForRequest(req, clients, gvk)
+					if err != nil {
+						writeStatus(rw, statusForError(err))
+						return direct
+					}
+
+					perms, err := requestAuthz.Permissions(ctx)
+					if err != nil {
+						writeStatus(rw, statusForError(err))
+						return direct
+					}
+
+					// namespaces whose permissions could not be discovered can't be listed
+					permissionFailures, err := getPermissionFailures(perms, opts.FieldSelector)
 					if err != nil {
-						klog.V(0).ErrorS(err, fmt.Sprintf("encountered an error marshalling json for %s", resourceList.GetKind()))
+						writeStatus(rw, &apierrors.NewBadRequest(err.Error()).ErrStatus)
+						return direct
 					}
 
-					rw.Header().Add("Content-Type", "application/json")
-					_, err = rw.Write(respJson)
+					if clients.Cache != nil {
+						resourceList, failures, cached, err := clients.Cache.getNamespacedResourceList(ctx, lister, perms, opts, options.MaxConcurrentLists)
+						if err != nil {
+							writeStatus(rw, statusForError(err))
+							return direct
+						}
+						if cached {
+							writePartialResourceList(rw, lister, resourceList, append(permissionFailures, failures...), options.PartialFailurePolicy)
+							return direct
+						}
+					}
+
+					resourceList, failures, err := getNamespacedResourceList(ctx, lister, perms, "list", opts, options.MaxConcurrentLists)
 					if err != nil {
-						klog.V(0).ErrorS(err, "encountered an error writing JSON to client")
+						writeStatus(rw, statusForError(err))
+						return direct
 					}
+					writePartialResourceList(rw, lister, resourceList, append(permissionFailures, failures...), options.PartialFailurePolicy)
+				}
+			}
+		} else if req.Method == http.MethodGet && isListRequest(req.URL) && !isWatchRequest(req.URL) {
+			info := parseRequestURL(req.URL)
+			gvr := info.groupVersionResource()
+			permitted, err := requestAuthz.Authorize(req.Context(), gvr, info.namespace, "list")
+			if err != nil {
+				writeStatus(rw, statusForError(err))
+				return direct
+			}
+
+			names := []string{}
+			if !permitted {
+				names, err = requestAuthz.PermittedNames(req.Context(), gvr, info.namespace, "get")
+				if err != nil {
+					writeStatus(rw, statusForError(err))
+					return direct
+				}
+			}
+
+			if permitted || len(names) == 0 { // has list permissions or nothing to fake
+				direct = true
+			} else { // time to fake the list from the permitted resource names
+				gvk, err := gvkFromURL(req.URL, cli.RESTMapper())
+				if err != nil {
+					klog.V(0).ErrorS(err, "encountered an error getting the GVK for request")
+					return true
+				}
+				opts, err := listOptionsFromRequest(req.URL)
+				if err != nil {
+					writeStatus(rw, &apierrors.NewBadRequest(err.Error()).ErrStatus)
+					return direct
+				}
+				lister, err := newResourceListerForRequest(req, clients, gvk)
+				if err != nil {
+					writeStatus(rw, statusForError(err))
+					return direct
+				}
+				if err := lister.validateFieldSelector(opts.FieldSelector); err != nil {
+					writeStatus(rw, statusForError(err))
+					return direct
+				}
+
+				resourceList, err := getNamedResourceList(req.Context(), lister, info.namespace, names, opts)
+				failures := []namespaceFailure{}
+				if err != nil {
+					failures = append(failures, namespaceFailure{namespace: info.namespace, err: err})
 				}
+				writePartialResourceList(rw, lister, resourceList, failures, options.PartialFailurePolicy)
 			}
 		} else {
 			direct = true
@@ -95,3 +335,151 @@ func HandleRequest(rw http.ResponseWriter, req *http.Request, rbac *rbac.RBACWat
 
 	return direct
 }
+
+// writeObject is a helper function to write an object to the http.ResponseWriter.
+// When protobuf is true the object is written as protobuf and otherwise the object
+// is written as JSON. Protobuf is only negotiated for types that support it, so the
+// object is never written as JSON to a client that only accepts protobuf.
+func writeObject(rw http.ResponseWriter, obj runtime.Unstructured, protobuf bool) {
+	if protobuf {
+		respProto, err := encodeProtobuf(obj)
+		if err != nil {
+			klog.V(0).ErrorS(err, "encountered an error encoding protobuf")
+			writeStatus(rw, &apierrors.NewInternalError(err).ErrStatus)
+			return
+		}
+
+		rw.Header().Set("Content-Type", protobufMediaType)
+		if _, err := rw.Write(respProto); err != nil {
+			klog.V(0).ErrorS(err, "encountered an error writing protobuf to client")
+		}
+		return
+	}
+
+	respJson, err := json.Marshal(obj)
+	if err != nil {
+		klog.V(0).ErrorS(err, fmt.Sprintf("encountered an error marshalling json for %s", obj.GetObjectKind().GroupVersionKind().Kind))
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	_, err = rw.Write(respJson)
+	if err != nil {
+		klog.V(0).ErrorS(err, "encountered an error writing JSON to client")
+	}
+}
+
+// deleteNamespacedCollection is a helper function that deletes the collection of resources of the
+// given GVK in every namespace that the permissions of the RequestAuthorizer include the deletecollection
+// permission for, narrowed to the namespace required by the field selector of the request if there is one.
+// The per-namespace results are written to the http.ResponseWriter as an aggregated Status.
+func deleteNamespacedCollection(rw http.ResponseWriter, req *http.Request, cli client.Client, gvk schema.GroupVersionKind, requestAuthz RequestAuthorizer, options Options) {
+	listOpts, err := listOptionsFromRequest(req.URL)
+	if err != nil {
+		writeStatus(rw, &apierrors.NewBadRequest(err.Error()).ErrStatus)
+		return
+	}
+	deleteOpts, err := deleteOptionsFromRequest(req)
+	if err != nil {
+		writeStatus(rw, statusForError(err))
+		return
+	}
+
+	gvr, err := getResourceForKind(cli.RESTMapper(), gvk)
+	if err != nil {
+		writeStatus(rw, statusForError(err))
+		return
+	}
+
+	selectedNamespace, selected, err := namespaceFromFieldSelector(listOpts.FieldSelector)
+	if err != nil {
+		writeStatus(rw, &apierrors.NewBadRequest(err.Error()).ErrStatus)
+		return
+	}
+	perms, err := requestAuthz.Permissions(req.Context())
+	if err != nil {
+		writeStatus(rw, statusForError(err))
+		return
+	}
+	namespaces := []string{}
+	for _, ns := range getPermittedNamespaces(perms, gvr, "deletecollection") {
+		if !selected || ns == selectedNamespace {
+			namespaces = append(namespaces, ns)
+		}
+	}
+
+	// namespaces whose permissions could not be discovered can't be deleted from
+	permissionFailures, err := getPermissionFailures(perms, listOpts.FieldSelector)
+	if err != nil {
+		writeStatus(rw, &apierrors.NewBadRequest(err.Error()).ErrStatus)
+		return
+	}
+
+	if len(namespaces) == 0 {
+		if len(permissionFailures) > 0 {
+			writeStatus(rw, statusForNamespaceFailures(permissionFailures))
+			return
+		}
+		writeStatus(rw, &apierrors.NewForbidden(gvr.GroupResource(), "", fmt.Errorf("deletecollection is not permitted in any namespace")).ErrStatus)
+		return
+	}
+
+	// client disconnects and the deadline cancel the deletes that are in flight
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if options.ListTimeout > 0 {
+		ctx, cancel = context.WithTimeout(req.Context(), options.ListTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(req.Context())
+	}
+	defer cancel()
+
+	failures := deleteNamespacedResources(ctx, cli, gvk, namespaces, listOpts, deleteOpts, options.MaxConcurrentLists)
+	writeStatus(rw, statusForDeleteCollection(gvk, gvr, namespaces, append(permissionFailures, failures...)))
+}
+
+// newResourceListerForRequest is a helper function to create a resourceLister for the given GVK
+// that lists the resources in the format that was requested by the client. It returns an error
+// if the client did not accept any of the supported formats.
+func newResourceListerForRequest(req *http.Request, clients *Clients, gvk schema.GroupVersionKind) (*resourceLister, error) {
+	format, protobuf, err := negotiateFormat(req, gvk)
+	if err != nil {
+		return nil, err
+	}
+
+	return newResourceLister(clients.Client, clients.RESTClient, gvk, format, protobuf, req.URL.Query().Get("includeObject"))
+}
+
+// writePartialResourceList is a helper function to write an unstructured.UnstructuredList that
+// is missing the resources of the failed namespaces to the http.ResponseWriter in the format of
+// the resourceLister according to the PartialFailurePolicy. Unless the policy is to warn, any
+// failure is written as a Status instead.
+func writePartialResourceList(rw http.ResponseWriter, l *resourceLister, resourceList *unstructured.UnstructuredList, failures []namespaceFailure, policy PartialFailurePolicy) {
+	if len(failures) > 0 {
+		if policy != PartialFailurePolicyWarn {
+			writeStatus(rw, statusForNamespaceFailures(failures))
+			return
+		}
+		warnNamespaceFailures(rw, failures)
+	}
+
+	l.write(rw, resourceList)
+}
+
+// HandleNotReady will respond to a proxy request that was received before the RBACWatcher
+// has synced its permissions. It accepts a http.ResponseWriter and http.Request and responds
+// with a retryable 503 Service Unavailable status that includes a Retry-After header.
+func HandleNotReady(rw http.ResponseWriter, req *http.Request) {
+	klog.V(0).Infof("RBAC permissions have not synced yet, rejecting %v %v", req.Method, req.URL.Path)
+
+	status := apierrors.NewServiceUnavailable("the proxy is waiting for RBAC permissions to sync").ErrStatus
+	status.Details = &metav1.StatusDetails{RetryAfterSeconds: notReadyRetryAfterSeconds}
+	writeStatus(rw, &status)
+}
+
+// HandleError will respond to a proxy request that could not be handled because of the given
+// error. It accepts a http.ResponseWriter, http.Request and error and responds with the status
+// of the error, or with a 500 Internal Server Error status if the error has no status.
+func HandleError(rw http.ResponseWriter, req *http.Request, err error) {
+	klog.V(0).Infof("encountered an error handling %v %v: %v", req.Method, req.URL.Path, err)
+	writeStatus(rw, statusForError(err))
+}
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/everettraven/rbac-proxy-poc/internal/rbac"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// fakeAuthorizer is an Authorizer that decides from a fixed PermissionsSnapshot
+type fakeAuthorizer struct {
+	perms *rbac.PermissionsSnapshot
+}
+
+func (a *fakeAuthorizer) HasSynced() bool {
+	return true
+}
+
+func (a *fakeAuthorizer) ForRequest() RequestAuthorizer {
+	return &snapshotAuthorizer{perms: a.perms}
+}
+
+func (a *fakeAuthorizer) Subscribe() (<-chan struct{}, func()) {
+	return make(chan struct{}), func() {}
+}
+
+// newTestClients is a helper function to create Clients backed by a fake client
+// with a RESTMapper that knows about namespaced pods and cluster scoped nodes
+func newTestClients() *Clients {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Node"}, meta.RESTScopeRoot)
+
+	return &Clients{
+		Client: fake.NewClientBuilder().WithRESTMapper(mapper).Build(),
+	}
+}
+
+func TestHandleRequestForwardsWrites(t *testing.T) {
+	// The caller can only get one pod by name and can't list anything
+	authz := &fakeAuthorizer{perms: &rbac.PermissionsSnapshot{
+		ClusterPermissions: rbac.Permissions{},
+		NamespacePermissions: rbac.NamespacedPermissions{
+			"default": {"/pods": {"get": rbac.ResourceNames{"my-pod": {}}}},
+		},
+	}}
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+	}{
+		{name: "create at the cluster level", method: http.MethodPost, url: "/api/v1/pods"},
+		{name: "update at the cluster level", method: http.MethodPut, url: "/api/v1/pods"},
+		{name: "patch at the cluster level", method: http.MethodPatch, url: "/api/v1/pods"},
+		{name: "create in a namespace with names-only grants", method: http.MethodPost, url: "/api/v1/namespaces/default/pods"},
+		{name: "patch in a namespace with names-only grants", method: http.MethodPatch, url: "/api/v1/namespaces/default/pods"},
+		{name: "create of a cluster scoped resource", method: http.MethodPost, url: "/api/v1/nodes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.url, nil)
+			rw := httptest.NewRecorder()
+
+			direct := HandleRequest(rw, req, authz, newTestClients(), Options{MaxConcurrentLists: 1})
+			if !direct {
+				t.Fatalf("expected %s %s to be proxied directly, got a %d response: %s", tt.method, tt.url, rw.Code, rw.Body.String())
+			}
+			if rw.Body.Len() != 0 {
+				t.Fatalf("expected nothing to be written for %s %s, got: %s", tt.method, tt.url, rw.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/everettraven/rbac-proxy-poc/internal/rbac"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// minReadCacheSweepInterval is the shortest interval that idle informers are stopped at
+	minReadCacheSweepInterval = time.Second
+	// readCacheSyncPollInterval is the interval that informers are checked for having synced at
+	readCacheSyncPollInterval = 100 * time.Millisecond
+)
+
+// readCacheKey is the key of the informer for a resource in a namespace
+type readCacheKey struct {
+	// The resource of the informer
+	gvr schema.GroupVersionResource
+	// The namespace of the informer
+	namespace string
+}
+
+// namespaceInformer is an informer for a resource in a namespace
+type namespaceInformer struct {
+	// The informer
+	informer cache.SharedIndexInformer
+	// The channel that is closed to stop the informer
+	stop chan struct{}
+	// The last time that the informer was read from
+	lastUsed time.Time
+
+	// The lock for the error
+	mu sync.Mutex
+	// The error of the last list or watch of the informer that failed, if any
+	err error
+}
+
+// setError is a helper function to record the error of a failed list or watch of the informer
+func (ni *namespaceInformer) setError(_ *cache.Reflector, err error) {
+	ni.mu.Lock()
+	defer ni.mu.Unlock()
+	ni.err = err
+}
+
+// waitForSync is a helper function that waits for the informer to sync. It stops waiting when
+// the informer fails to list or watch before it has synced, because it may never sync. It returns
+// nil if the informer has synced, the error that it failed with if it has not, and the error of
+// the context if the context is done before either happens.
+func (ni *namespaceInformer) waitForSync(ctx context.Context) error {
+	ticker := time.NewTicker(readCacheSyncPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if ni.informer.HasSynced() {
+			return nil
+		}
+
+		ni.mu.Lock()
+		err := ni.err
+		ni.mu.Unlock()
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// ReadCache serves merged lists from informers that are started for each namespace
+// of the resources that clients ask about. The informers for a resource in a namespace
+// are stopped once they have not been read from for the TTL of the ReadCache.
+type ReadCache struct {
+	// The client used by the informers
+	client dynamic.Interface
+	// How long an informer is kept after it was last read from
+	ttl time.Duration
+
+	// The lock for the informers
+	mu sync.Mutex
+	// The running informers
+	informers map[readCacheKey]*namespaceInformer
+}
+
+// NewReadCache creates a new ReadCache for the given rest.Config that stops
+// informers that have not been read from for the given TTL
+func NewReadCache(cfg *rest.Config, ttl time.Duration) (*ReadCache, error) {
+	client, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("encountered an error creating a new dynamic client: %w", err)
+	}
+
+	return &ReadCache{
+		client:    client,
+		ttl:       ttl,
+		informers: map[readCacheKey]*namespaceInformer{},
+	}, nil
+}
+
+// Start starts stopping the informers of the ReadCache that are idle. Every
+// informer is stopped when the context is closed. This function is blocking.
+func (c *ReadCache) Start(ctx context.Context) error {
+	interval := c.ttl / 2
+	if interval < minReadCacheSweepInterval {
+		interval = minReadCacheSweepInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			c.stopIdle(time.Time{})
+			return nil
+		case now := <-ticker.C:
+			c.stopIdle(now.Add(-c.ttl))
+		}
+	}
+}
+
+// stopIdle stops the informers that have not been read from since the given time.
+// The zero time stops every informer.
+func (c *ReadCache) stopIdle(since time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, ni := range c.informers {
+		if since.IsZero() || ni.lastUsed.Before(since) {
+			klog.V(0).Infof("stopping idle informer for %s in namespace `%s`", key.gvr, key.namespace)
+			close(ni.stop)
+			delete(c.informers, key)
+		}
+	}
+}
+
+// informerFor gets the informer for a resource in a namespace, starting
+// it if it is not running, and marks the informer as read from
+func (c *ReadCache) informerFor(gvr schema.GroupVersionResource, namespace string) *namespaceInformer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := readCacheKey{gvr: gvr, namespace: namespace}
+	if ni, ok := c.informers[key]; ok {
+		ni.lastUsed = time.Now()
+		return ni
+	}
+
+	klog.V(0).Infof("starting informer for %s in namespace `%s`", gvr, namespace)
+	ni := &namespaceInformer{
+		informer: dynamicinformer.NewFilteredDynamicInformer(c.client, gvr, namespace, 0, cache.Indexers{}, nil).Informer(),
+		stop:     make(chan struct{}),
+		lastUsed: time.Now(),
+	}
+	if err := ni.informer.SetWatchErrorHandler(ni.setError); err != nil {
+		klog.V(0).ErrorS(err, fmt.Sprintf("encountered an error setting the watch error handler of the informer for %s in namespace `%s`", gvr, namespace))
+	}
+	go ni.informer.Run(ni.stop)
+
+	c.informers[key] = ni
+	return ni
+}
+
+// getNamespacedResourceList is a helper function that when given a resourceLister, PermissionsSnapshot,
+// the metav1.ListOptions of the request, and a number of workers it will return a list of resources from
+// all the namespaces that include the list permission for the resources of the resourceLister condensed
+// into one resource list that is served from the informers of the ReadCache. The resourceVersion of the
+// merged list is the oldest resourceVersion that the namespaces were listed at, so a merged watch started
+// from it does not miss events. The list can only be served from the informers if the resources are listed
+// as the resource Kind, every namespace can be both listed and watched, and the list options can be satisfied
+// by a cache. Namespaces whose informer fails to list or watch before it has synced are listed from the
+// Kubernetes API instead by at most the given number of workers, and the namespaces that can't be listed
+// either are reported as namespaceFailures. It returns an unstructured.UnstructuredList, the namespaceFailures,
+// a bool that is true if the list was served from the ReadCache and false if it was not, and an error if the
+// field selector is not valid, if a namespace can't be listed from the Kubernetes API in a way that fails the
+// whole list, or if the context is done before the informers have synced.
+func (c *ReadCache) getNamespacedResourceList(ctx context.Context, l *resourceLister, perms *rbac.PermissionsSnapshot, opts metav1.ListOptions, workers int) (*unstructured.UnstructuredList, []namespaceFailure, bool, error) {
+	if l.format != formatList || !isCacheableListOptions(opts) {
+		return nil, nil, false, nil
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	sources, err := getNamespaceSources(perms, l.gvr, "list", opts.FieldSelector)
+	if err != nil {
+		return nil, nil, true, apierrors.NewBadRequest(err.Error())
+	}
+	for _, src := range sources {
+		if src.names != nil || !perms.NamespaceAllows(src.namespace, l.gvr.Group, l.gvr.Resource, "watch") {
+			return nil, nil, false, nil
+		}
+	}
+
+	informers := []*namespaceInformer{}
+	for _, src := range sources {
+		informers = append(informers, c.informerFor(l.gvr, src.namespace))
+	}
+
+	synced := []cache.SharedIndexInformer{}
+	unsynced := []namespaceSource{}
+	for i, ni := range informers {
+		if err := ni.waitForSync(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil, nil, true, apierrors.NewTimeoutError(fmt.Sprintf("encountered a timeout syncing %s for namespace `%s`", l.gvr.Resource, sources[i].namespace), 0)
+			}
+			klog.V(0).ErrorS(err, fmt.Sprintf("informer for %s in namespace `%s` has not synced, listing it from the Kubernetes API", l.gvr.Resource, sources[i].namespace))
+			unsynced = append(unsynced, sources[i])
+			continue
+		}
+		synced = append(synced, ni.informer)
+	}
+
+	resourceList := l.newList()
+	resourceVersion := uint64(0)
+	for _, informer := range synced {
+		items := []*unstructured.Unstructured{}
+		for _, obj := range informer.GetStore().List() {
+			u, ok := obj.(*unstructured.Unstructured)
+			if !ok || !matchesSelectors(u, opts) {
+				continue
+			}
+			items = append(items, u)
+		}
+
+		sort.Slice(items, func(i, j int) bool {
+			return items[i].GetName() < items[j].GetName()
+		})
+		for _, u := range items {
+			resourceList.Items = append(resourceList.Items, *u.DeepCopy())
+		}
+
+		rv := parseResourceVersion(informer.LastSyncResourceVersion())
+		if resourceVersion == 0 || rv < resourceVersion {
+			resourceVersion = rv
+		}
+	}
+
+	// the limit is ignored like it is for the lists served from the informers
+	version := listVersion{resourceVersion: opts.ResourceVersion, match: opts.ResourceVersionMatch}
+	failures := []namespaceFailure{}
+	for i, result := range listNamespaceSources(ctx, l, unsynced, listContinue{}, 0, version, opts, workers) {
+		if ctx.Err() != nil {
+			return nil, nil, true, apierrors.NewTimeoutError(fmt.Sprintf("encountered a timeout listing %s", l.gvr.Resource), 0)
+		}
+		if result.err != nil {
+			return nil, nil, true, result.err
+		}
+		if result.failure != nil {
+			klog.V(0).ErrorS(result.failure, fmt.Sprintf("encountered an error getting %s for namespace `%s`", l.gvr.Resource, unsynced[i].namespace))
+			failures = append(failures, namespaceFailure{namespace: unsynced[i].namespace, err: result.failure})
+		}
+		resourceList.Items = append(resourceList.Items, result.items...)
+
+		rv := parseResourceVersion(result.version.resourceVersion)
+		if rv > 0 && (resourceVersion == 0 || rv < resourceVersion) {
+			resourceVersion = rv
+		}
+	}
+
+	// the namespaces listed from the Kubernetes API are merged in namespace order
+	sort.SliceStable(resourceList.Items, func(i, j int) bool {
+		return resourceList.Items[i].GetNamespace() < resourceList.Items[j].GetNamespace()
+	})
+
+	if resourceVersion > 0 {
+		resourceList.SetResourceVersion(strconv.FormatUint(resourceVersion, 10))
+	}
+	return resourceList, failures, true, nil
+}
+
+// isCacheableListOptions is a helper function to determine if a list with the metav1.ListOptions
+// can be served from a cache. A list that does not continue a previous list can be served from a
+// cache when resourceVersion is `0`, and because the read cache is opt-in, also when resourceVersion
+// is not set. Like the watch cache of the Kubernetes API server, the limit is ignored for lists where
+// resourceVersion is `0` and lists with a limit are not served from a cache otherwise. Field selectors
+// can only be evaluated for the metadata fields of a resource.
+// Returns a bool that is true if the list can be served from a cache and false if it can not
+func isCacheableListOptions(opts metav1.ListOptions) bool {
+	if opts.Continue != "" || (opts.ResourceVersion != "" && opts.ResourceVersion != "0") {
+		return false
+	}
+	if opts.ResourceVersionMatch != "" && opts.ResourceVersionMatch != metav1.ResourceVersionMatchNotOlderThan {
+		return false
+	}
+	if opts.Limit > 0 && opts.ResourceVersion != "0" {
+		return false
+	}
+
+	if _, err := labels.Parse(opts.LabelSelector); err != nil {
+		return false
+	}
+
+	if opts.FieldSelector != "" {
+		selector, err := fields.ParseSelector(opts.FieldSelector)
+		if err != nil {
+			return false
+		}
+		for _, req := range selector.Requirements() {
+			if req.Field != "metadata.name" && req.Field != "metadata.namespace" {
+				return false
+			}
+		}
+	}
+
+	return true
+}
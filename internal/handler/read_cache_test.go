@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// newTestNamespaceInformer is a helper function to create a running namespaceInformer
+// whose lists return the given error, or an empty list if the error is nil
+func newTestNamespaceInformer(t *testing.T, listErr error) *namespaceInformer {
+	t.Helper()
+
+	lw := &cache.ListWatch{
+		ListFunc: func(metav1.ListOptions) (runtime.Object, error) {
+			if listErr != nil {
+				return nil, listErr
+			}
+			list := &unstructured.UnstructuredList{}
+			list.SetResourceVersion("10")
+			return list, nil
+		},
+		WatchFunc: func(metav1.ListOptions) (watch.Interface, error) {
+			return watch.NewFake(), nil
+		},
+	}
+
+	ni := &namespaceInformer{
+		informer: cache.NewSharedIndexInformer(lw, &unstructured.Unstructured{}, 0, cache.Indexers{}),
+		stop:     make(chan struct{}),
+	}
+	if err := ni.informer.SetWatchErrorHandler(ni.setError); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	go ni.informer.Run(ni.stop)
+	t.Cleanup(func() { close(ni.stop) })
+	return ni
+}
+
+func TestNamespaceInformerWaitForSync(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := newTestNamespaceInformer(t, nil).waitForSync(ctx); err != nil {
+		t.Fatalf("expected the informer to sync, got %v", err)
+	}
+
+	// an informer that can't list stops the wait before the context is done
+	if err := newTestNamespaceInformer(t, errors.New("forbidden")).waitForSync(ctx); err == nil || !strings.Contains(err.Error(), "forbidden") {
+		t.Fatalf("expected the list error of the informer, got %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("expected the wait to stop before the context is done")
+	}
+}
@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog/v2"
+)
+
+// statusCauseDeleted is the type of the status cause for a namespace that a collection was deleted from
+const statusCauseDeleted metav1.CauseType = "Deleted"
+
+// writeStatus is a helper function to write a metav1.Status to the
+// http.ResponseWriter as JSON using the code of the status as the
+// HTTP status code of the response. A Retry-After header is set when
+// the status includes a retry delay.
+func writeStatus(rw http.ResponseWriter, status *metav1.Status) {
+	status.Kind = "Status"
+	status.APIVersion = "v1"
+
+	if status.Details != nil && status.Details.RetryAfterSeconds > 0 {
+		rw.Header().Set("Retry-After", strconv.Itoa(int(status.Details.RetryAfterSeconds)))
+	}
+
+	respJson, err := json.Marshal(status)
+	if err != nil {
+		klog.V(0).ErrorS(err, "encountered an error marshalling json for Status")
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(int(status.Code))
+	_, err = rw.Write(respJson)
+	if err != nil {
+		klog.V(0).ErrorS(err, "encountered an error writing JSON to client")
+	}
+}
+
+// statusForError is a helper function to get the metav1.Status to respond with for an error.
+// Errors returned by the Kubernetes API server keep their original status and any other
+// error is treated as an internal error.
+func statusForError(err error) *metav1.Status {
+	var apiStatus apierrors.APIStatus
+	if errors.As(err, &apiStatus) {
+		status := apiStatus.Status()
+		return &status
+	}
+
+	return &apierrors.NewInternalError(err).ErrStatus
+}
+
+// namespaceFailure is a namespace of a merged list that could not be listed completely
+type namespaceFailure struct {
+	// The namespace that failed, empty for cluster scoped resources
+	namespace string
+	// The error the namespace failed with
+	err error
+}
+
+// message is a helper function to get a message describing the namespaceFailure
+func (f namespaceFailure) message() string {
+	if f.namespace == "" {
+		return f.err.Error()
+	}
+
+	return fmt.Sprintf("namespace `%s`: %s", f.namespace, f.err.Error())
+}
+
+// statusForNamespaceFailures is a helper function to get the metav1.Status to respond with when
+// namespaces of a merged list failed. Each failed namespace is included as a cause of the status.
+// When every namespace failed with the same status code the code, reason and retry delay of the
+// upstream status are kept. When the namespaces failed with different client errors the status
+// of the client error that the most namespaces failed with is kept, so that e.g. a mix of
+// Forbidden and NotFound namespaces is still a client error. Any other mix of failures is treated
+// as an internal error.
+func statusForNamespaceFailures(failures []namespaceFailure) *metav1.Status {
+	statuses := []*metav1.Status{}
+	counts := map[int32]int{}
+	clientErrors := true
+	messages := []string{}
+	causes := []metav1.StatusCause{}
+	retryAfterSeconds := int32(0)
+	for _, f := range failures {
+		failureStatus := statusForError(f.err)
+		statuses = append(statuses, failureStatus)
+		counts[failureStatus.Code]++
+		if failureStatus.Code < 400 || failureStatus.Code >= 500 {
+			clientErrors = false
+		}
+		if failureStatus.Details != nil && failureStatus.Details.RetryAfterSeconds > retryAfterSeconds {
+			retryAfterSeconds = failureStatus.Details.RetryAfterSeconds
+		}
+
+		messages = append(messages, f.message())
+		causes = append(causes, metav1.StatusCause{
+			Type:    metav1.CauseType(failureStatus.Reason),
+			Message: f.message(),
+		})
+	}
+
+	// The first of the statuses with the most common code, so ties go to the first namespace
+	status := statuses[0]
+	for _, failureStatus := range statuses {
+		if counts[failureStatus.Code] > counts[status.Code] {
+			status = failureStatus
+		}
+	}
+
+	if len(counts) > 1 && !clientErrors {
+		status = &apierrors.NewInternalError(errors.New("the namespaces failed with different errors")).ErrStatus
+	}
+
+	return &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    status.Code,
+		Reason:  status.Reason,
+		Message: fmt.Sprintf("encountered errors in namespaces: %s", strings.Join(messages, "; ")),
+		Details: &metav1.StatusDetails{
+			Causes:            causes,
+			RetryAfterSeconds: retryAfterSeconds,
+		},
+	}
+}
+
+// statusForDeleteCollection is a helper function to get the metav1.Status to respond with when a
+// collection of resources of the GroupVersionKind and GroupVersionResource was deleted from each of
+// the namespaces. Each namespace is included as a cause of the status. When namespaces failed the status
+// is the status of the namespaceFailures, with the namespaces that succeeded included as `Deleted` causes.
+func statusForDeleteCollection(gvk schema.GroupVersionKind, gvr schema.GroupVersionResource, namespaces []string, failures []namespaceFailure) *metav1.Status {
+	failed := map[string]struct{}{}
+	for _, f := range failures {
+		failed[f.namespace] = struct{}{}
+	}
+
+	deleted := []metav1.StatusCause{}
+	for _, namespace := range namespaces {
+		if _, ok := failed[namespace]; !ok {
+			deleted = append(deleted, metav1.StatusCause{
+				Type:    statusCauseDeleted,
+				Message: fmt.Sprintf("namespace `%s`: deleted the collection of %s", namespace, gvr.Resource),
+			})
+		}
+	}
+
+	if len(failures) > 0 {
+		status := statusForNamespaceFailures(failures)
+		status.Details.Causes = append(status.Details.Causes, deleted...)
+		return status
+	}
+
+	return &metav1.Status{
+		Status:  metav1.StatusSuccess,
+		Code:    http.StatusOK,
+		Message: fmt.Sprintf("deleted the collection of %s in namespaces: %s", gvr.Resource, strings.Join(namespaces, ", ")),
+		Details: &metav1.StatusDetails{
+			Group:  gvk.Group,
+			Kind:   gvk.Kind,
+			Causes: deleted,
+		},
+	}
+}
+
+// warnNamespaceFailures is a helper function to add a Warning header to the
+// http.ResponseWriter for each of the namespaces of a merged list that failed
+func warnNamespaceFailures(rw http.ResponseWriter, failures []namespaceFailure) {
+	for _, f := range failures {
+		warning := fmt.Sprintf("the list is incomplete, %s", f.message())
+		rw.Header().Add("Warning", fmt.Sprintf("299 - %q", warning))
+	}
+}
@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestStatusForNamespaceFailures(t *testing.T) {
+	pods := schema.GroupResource{Resource: "pods"}
+	forbidden := apierrors.NewForbidden(pods, "", errors.New("denied"))
+	notFound := apierrors.NewNotFound(pods, "")
+	unavailable := apierrors.NewServiceUnavailable("unavailable")
+
+	tests := []struct {
+		name     string
+		failures []namespaceFailure
+		code     int32
+	}{
+		{
+			name:     "same client error",
+			failures: []namespaceFailure{{namespace: "a", err: forbidden}, {namespace: "b", err: forbidden}},
+			code:     http.StatusForbidden,
+		},
+		{
+			name:     "mixed client errors",
+			failures: []namespaceFailure{{namespace: "a", err: notFound}, {namespace: "b", err: forbidden}, {namespace: "c", err: forbidden}},
+			code:     http.StatusForbidden,
+		},
+		{
+			name:     "mixed client errors with a tie",
+			failures: []namespaceFailure{{namespace: "a", err: notFound}, {namespace: "b", err: forbidden}},
+			code:     http.StatusNotFound,
+		},
+		{
+			name:     "client and server errors",
+			failures: []namespaceFailure{{namespace: "a", err: forbidden}, {namespace: "b", err: unavailable}},
+			code:     http.StatusInternalServerError,
+		},
+		{
+			name:     "same server error",
+			failures: []namespaceFailure{{namespace: "a", err: unavailable}, {namespace: "b", err: unavailable}},
+			code:     http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := statusForNamespaceFailures(tt.failures)
+			if status.Code != tt.code {
+				t.Fatalf("expected code %d, got %d", tt.code, status.Code)
+			}
+			if len(status.Details.Causes) != len(tt.failures) {
+				t.Fatalf("expected a cause for each of the %d namespaces, got %d", len(tt.failures), len(status.Details.Causes))
+			}
+		})
+	}
+}
+
+func TestStatusForDeleteCollection(t *testing.T) {
+	gvk := schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+	gvr := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+
+	status := statusForDeleteCollection(gvk, gvr, []string{"a", "b"}, nil)
+	if status.Code != http.StatusOK {
+		t.Fatalf("expected code %d, got %d", http.StatusOK, status.Code)
+	}
+	if status.Details.Group != "apps" || status.Details.Kind != "Deployment" {
+		t.Fatalf("expected the details to be for apps Deployment, got group %q and kind %q", status.Details.Group, status.Details.Kind)
+	}
+	if len(status.Details.Causes) != 2 {
+		t.Fatalf("expected a cause for each namespace, got %v", status.Details.Causes)
+	}
+}
@@ -1,32 +1,151 @@
 package handler
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 
-	"golang.org/x/text/cases"
-	"golang.org/x/text/language"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/klog/v2"
 )
 
-// isClusterScopedRequest is a helper function that determines if
-// a request URL is making a cluster level request. Returns a bool
-// that is true is it is cluster scoped and false if it is not.
-func isClusterScopedRequest(url *url.URL) bool {
-	output := true
+// namespaceSubresources are the subresources of a Namespace that
+// must not be mistaken for a resource within the namespace
+var namespaceSubresources = map[string]struct{}{
+	"status":   {},
+	"finalize": {},
+}
+
+// requestInfo is the information about a request
+// that can be parsed from the request URL
+type requestInfo struct {
+	// Whether or not the request is for an API resource
+	isResourceRequest bool
+	// The API group of the requested resource
+	group string
+	// The API version of the requested resource
+	version string
+	// The namespace of the request, empty if the request is not in a namespace
+	namespace string
+	// The requested resource (i.e. pods)
+	resource string
+	// The name of the requested resource, empty if the request is for a collection
+	name string
+	// The requested subresource (i.e. status)
+	subresource string
+}
+
+// groupVersionResource is a helper function to get the
+// GroupVersionResource of the requested resource
+func (ri requestInfo) groupVersionResource() schema.GroupVersionResource {
+	return schema.GroupVersionResource{
+		Group:    ri.group,
+		Version:  ri.version,
+		Resource: ri.resource,
+	}
+}
+
+// parseRequestURL is a helper function to parse the requestInfo from a
+// request URL. It follows the same path conventions as the Kubernetes API server:
+// /api/{version}/{resource}/{name}/{subresource}
+// /api/{version}/namespaces/{namespace}/{resource}/{name}/{subresource}
+// /apis/{group}/{version}/{resource}/{name}/{subresource}
+// /apis/{group}/{version}/namespaces/{namespace}/{resource}/{name}/{subresource}
+func parseRequestURL(url *url.URL) requestInfo {
+	info := requestInfo{}
 	path := strings.Trim(url.EscapedPath(), "/")
-	klog.V(0).Infof("PATH -- ", path)
+	klog.V(5).Infof("PATH -- %s", path)
 
 	paths := strings.Split(path, "/")
-	if paths[0] == "api" {
-		output = !(len(paths) >= 5)
-	} else if paths[0] == "apis" {
-		output = !(len(paths) > 5)
+	switch paths[0] {
+	case "api":
+		if len(paths) < 3 {
+			return info
+		}
+		info.version = paths[1]
+		paths = paths[2:]
+	case "apis":
+		if len(paths) < 4 {
+			return info
+		}
+		info.group = paths[1]
+		info.version = paths[2]
+		paths = paths[3:]
+	default:
+		return info
 	}
 
-	klog.V(0).Infof("isClusterScoped? -- ", output)
-	return output
+	if paths[0] == "namespaces" && len(paths) > 1 {
+		info.namespace = paths[1]
+		if len(paths) > 2 {
+			if _, ok := namespaceSubresources[paths[2]]; !ok {
+				paths = paths[2:]
+			}
+		}
+	}
+
+	info.isResourceRequest = true
+	info.resource = paths[0]
+	if len(paths) > 1 {
+		info.name = paths[1]
+	}
+	if len(paths) > 2 {
+		info.subresource = paths[2]
+	}
+
+	// A request for a namespace itself is not in a namespace
+	if info.group == "" && info.resource == "namespaces" {
+		info.namespace = ""
+	}
+
+	klog.V(5).Infof("REQUEST INFO -- %+v", info)
+	return info
+}
+
+// isClusterScopedRequest is a helper function that determines if
+// a request URL is making a cluster level request for a namespaced resource.
+// Whether or not the resource is namespaced is determined using the provided
+// meta.RESTMapper. Returns a bool that is true if it is a cluster level request
+// for a namespaced resource and false if it is not.
+func isClusterScopedRequest(url *url.URL, mapper meta.RESTMapper) bool {
+	info := parseRequestURL(url)
+	if !info.isResourceRequest || info.namespace != "" {
+		return false
+	}
+
+	gvk, err := gvkFromURL(url, mapper)
+	if err != nil {
+		klog.V(0).ErrorS(err, "encountered an error getting the GVK for request")
+		return false
+	}
+
+	namespaced, err := isNamespaced(mapper, gvk)
+	if err != nil {
+		klog.V(0).ErrorS(err, "encountered an error getting the scope for request")
+		return false
+	}
+
+	klog.V(5).Infof("isClusterScoped? -- %v", namespaced)
+	return namespaced
+}
+
+// isNamespaced is a helper function that uses the provided meta.RESTMapper to determine
+// if a GroupVersionKind is namespaced. Returns a bool that is true if it is namespaced
+// and false if it is cluster scoped.
+func isNamespaced(mapper meta.RESTMapper, gvk schema.GroupVersionKind) (bool, error) {
+	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return false, fmt.Errorf("encountered an error getting the RESTMapping for %s: %w", gvk, err)
+	}
+
+	return mapping.Scope.Name() == meta.RESTScopeNameNamespace, nil
 }
 
 // isListRequest is a helper function that determines if
@@ -34,27 +153,34 @@ func isClusterScopedRequest(url *url.URL) bool {
 // Returns a bool that is true if it is a list request
 // and false if it is not
 func isListRequest(url *url.URL) bool {
-	output := true
-	path := strings.Trim(url.EscapedPath(), "/")
-	klog.V(0).Infof("PATH -- ", path)
-
-	paths := strings.Split(path, "/")
-	if paths[0] == "api" {
-		output = !(len(paths) == 4 || len(paths) == 6)
-	} else if paths[0] == "apis" {
-		output = !(len(paths) == 5 || len(paths) == 7)
-	}
+	info := parseRequestURL(url)
+	output := info.isResourceRequest && info.name == ""
 
-	klog.V(0).Infof("isListRequest? -- ", output)
+	klog.V(5).Infof("isListRequest? -- %v", output)
 	return output
 }
 
 // isWatchRequest is a helper function to determine if a
-// request URL is a watch request. Returns a bool that is true
-// if it is a watch request and false if it is not
+// request URL is a watch request. Like the Kubernetes API server,
+// the `watch` parameter makes it a watch request unless its value
+// is false. Returns a bool that is true if it is a watch request
+// and false if it is not
 func isWatchRequest(url *url.URL) bool {
-	out := url.Query().Has("watch")
-	klog.V(0).Infof("isWatchRequest? -- ", out)
+	out := false
+	if values, ok := url.Query()["watch"]; ok {
+		watch, err := strconv.ParseBool(values[0])
+		out = values[0] == "" || err != nil || watch
+	}
+	klog.V(5).Infof("isWatchRequest? -- %v", out)
+	return out
+}
+
+// isDeleteCollectionRequest is a helper function to determine if a
+// request is to delete a collection of resources. Returns a bool that
+// is true if it is a deletecollection request and false if it is not
+func isDeleteCollectionRequest(req *http.Request) bool {
+	out := req.Method == http.MethodDelete && isListRequest(req.URL)
+	klog.V(5).Infof("isDeleteCollectionRequest? -- %v", out)
 	return out
 }
 
@@ -62,99 +188,70 @@ func isWatchRequest(url *url.URL) bool {
 // request URL is a request for a specific resource. Returns a
 // bool that true if it is and false if it is not
 func isSpecificRequest(url *url.URL) bool {
-	out := true
-	path := strings.Trim(url.EscapedPath(), "/")
-	klog.V(0).Infof("PATH -- ", path)
-
-	paths := strings.Split(path, "/")
-	if paths[0] == "api" {
-		if isClusterScopedRequest(url) {
-			out = len(paths) == 4
-		} else {
-			out = len(paths) == 6
-		}
-	} else if paths[0] == "apis" {
-		if isClusterScopedRequest(url) {
-			out = len(paths) == 5
-		} else {
-			out = len(paths) == 7
-		}
-	}
+	info := parseRequestURL(url)
+	out := info.isResourceRequest && info.name != ""
 
-	klog.V(0).Infof("isSpecificRequest? -- ", out)
+	klog.V(5).Infof("isSpecificRequest? -- %v", out)
 	return out
 }
 
-// gvkFromURL is a helper function to parse a GroupVersionKind
+// gvrFromURL is a helper function to parse a GroupVersionResource
 // from a request URL.
-func gvkFromURL(url *url.URL) schema.GroupVersionKind {
-	return schema.GroupVersionKind{
-		Group:   groupFromURL(url),
-		Version: versionFromURL(url),
-		Kind:    kindFromURL(url),
-	}
+func gvrFromURL(url *url.URL) schema.GroupVersionResource {
+	return parseRequestURL(url).groupVersionResource()
 }
 
-// kindFromURL is a helper function to parse a Kind from
-// a request URL.
-func kindFromURL(url *url.URL) string {
-	caser := cases.Title(language.AmericanEnglish)
-	kind := ""
-	path := strings.Trim(url.EscapedPath(), "/")
-	klog.V(0).Infof("PATH -- ", path)
-
-	paths := strings.Split(path, "/")
-	if paths[0] == "api" {
-		if isClusterScopedRequest(url) {
-			kind = paths[2]
-		} else {
-			kind = paths[4]
-		}
-	} else if paths[0] == "apis" {
-		if isClusterScopedRequest(url) {
-			kind = paths[3]
-		} else {
-			kind = paths[5]
-		}
+// gvkFromURL is a helper function to get the GroupVersionKind for
+// the resource of a request URL. The Kind is resolved using the
+// provided meta.RESTMapper.
+func gvkFromURL(url *url.URL, mapper meta.RESTMapper) (schema.GroupVersionKind, error) {
+	gvr := gvrFromURL(url)
+	gvk, err := mapper.KindFor(gvr)
+	if err != nil {
+		return schema.GroupVersionKind{}, fmt.Errorf("encountered an error getting the Kind for %s: %w", gvr, err)
 	}
 
-	kind = caser.String(strings.TrimSuffix(kind, "s"))
-	klog.V(0).Infof("KIND -- ", kind)
-	return kind
+	klog.V(5).Infof("GVK -- %s", gvk)
+	return gvk, nil
 }
 
-// groupFromURL is a helper function to parse a Group from
-// a request URL.
-func groupFromURL(url *url.URL) string {
-	group := ""
-	path := strings.Trim(url.EscapedPath(), "/")
-	klog.V(0).Infof("PATH -- ", path)
-
-	paths := strings.Split(path, "/")
-	if paths[0] == "api" {
-		group = ""
-	} else if paths[0] == "apis" {
-		group = paths[1]
+// listOptionsFromRequest is a helper function to get the list options
+// that were requested by the client from the request URL.
+func listOptionsFromRequest(url *url.URL) (metav1.ListOptions, error) {
+	opts := metav1.ListOptions{}
+	err := metav1.ParameterCodec.DecodeParameters(url.Query(), metav1.SchemeGroupVersion, &opts)
+	if err != nil {
+		return opts, fmt.Errorf("encountered an error parsing list options: %w", err)
 	}
 
-	klog.V(0).Infof("GROUP -- ", group)
-	return group
+	return opts, nil
 }
 
-// versionFromURL is a helper function to parse a Version
-// from a request URL.
-func versionFromURL(url *url.URL) string {
-	version := ""
-	path := strings.Trim(url.EscapedPath(), "/")
-	klog.V(0).Infof("PATH -- ", path)
+// deleteOptionsFromRequest is a helper function to get the delete options that were
+// requested by the client from the request URL and the request body, if it has one.
+// The body is decoded according to its Content-Type. It returns a BadRequest error if
+// the delete options can't be parsed and an UnsupportedMediaType error if the body is
+// neither JSON nor protobuf.
+func deleteOptionsFromRequest(req *http.Request) (metav1.DeleteOptions, error) {
+	opts := metav1.DeleteOptions{}
+	err := metav1.ParameterCodec.DecodeParameters(req.URL.Query(), metav1.SchemeGroupVersion, &opts)
+	if err != nil {
+		return opts, apierrors.NewBadRequest(fmt.Sprintf("encountered an error parsing delete options: %v", err))
+	}
 
-	paths := strings.Split(path, "/")
-	if paths[0] == "api" {
-		version = paths[1]
-	} else if paths[0] == "apis" {
-		version = paths[2]
+	if req.Body == nil {
+		return opts, nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return opts, apierrors.NewBadRequest(fmt.Sprintf("encountered an error reading delete options: %v", err))
+	}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := decodeDeleteOptions(req.Header.Get("Content-Type"), body, &opts); err != nil {
+			return opts, err
+		}
 	}
 
-	klog.V(0).Infof("VERSION -- ", version)
-	return version
+	return opts, nil
 }
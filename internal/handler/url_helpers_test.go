@@ -0,0 +1,32 @@
+package handler
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestIsWatchRequest(t *testing.T) {
+	tests := []struct {
+		query string
+		watch bool
+	}{
+		{query: "", watch: false},
+		{query: "watch", watch: true},
+		{query: "watch=", watch: true},
+		{query: "watch=true", watch: true},
+		{query: "watch=1", watch: true},
+		{query: "watch=false", watch: false},
+		{query: "watch=0", watch: false},
+		{query: "watch=False", watch: false},
+		{query: "limit=10&watch=false", watch: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			u := &url.URL{Path: "/api/v1/pods", RawQuery: tt.query}
+			if watch := isWatchRequest(u); watch != tt.watch {
+				t.Fatalf("expected watch to be %t for %q, got %t", tt.watch, tt.query, watch)
+			}
+		})
+	}
+}
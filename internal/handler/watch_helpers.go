@@ -0,0 +1,579 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/everettraven/rbac-proxy-poc/internal/rbac"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// namespacedEvent is a watch.Event along with
+// the namespace whose watch it was received from
+type namespacedEvent struct {
+	namespace string
+	event     watch.Event
+}
+
+// namespaceWatch is an upstream watch for a single namespace
+type namespaceWatch struct {
+	// The upstream watch
+	watch watch.Interface
+	// The function that stops forwarding events from the upstream watch
+	cancel context.CancelFunc
+	// The objects that have been sent to the client for the namespace keyed by name
+	objects map[string]runtime.Object
+	// The resourceVersion that all events of the namespace have been received up to
+	progress uint64
+}
+
+// namespacedWatch multiplexes the events from a set of per-namespace watches into a single
+// watch stream. The events are written as soon as they are received, and a merged bookmark
+// is only written once every namespace has progressed past its resourceVersion so that a
+// client that resumes the merged watch from the last bookmark it received can't skip events.
+type namespacedWatch struct {
+	// The client used to open the per-namespace watches
+	cli client.WithWatch
+	// The GVK of the resource being watched
+	gvk schema.GroupVersionKind
+	// The GVR of the resource being watched
+	gvr schema.GroupVersionResource
+	// The watch options requested by the client
+	opts metav1.ListOptions
+	// The namespace required by the field selector of the watch options, if any
+	selectedNamespace string
+	// Whether or not the field selector of the watch options requires a namespace
+	namespaceSelected bool
+	// The channel that the events of every namespace are sent to
+	events chan namespacedEvent
+	// The channel that a namespace is sent to when its watch closes
+	closed chan string
+	// The upstream watches keyed by namespace
+	watches map[string]*namespaceWatch
+	// The resourceVersion of the last bookmark sent to the client
+	bookmark uint64
+}
+
+// newNamespacedWatch creates a new namespacedWatch for the given GVK, GVR and watch options.
+// It returns an error if the field selector of the watch options is not valid.
+func newNamespacedWatch(cli client.WithWatch, gvk schema.GroupVersionKind, gvr schema.GroupVersionResource, opts metav1.ListOptions) (*namespacedWatch, error) {
+	selectedNamespace, namespaceSelected, err := namespaceFromFieldSelector(opts.FieldSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	return &namespacedWatch{
+		cli:               cli,
+		gvk:               gvk,
+		gvr:               gvr,
+		opts:              opts,
+		selectedNamespace: selectedNamespace,
+		namespaceSelected: namespaceSelected,
+		events:            make(chan namespacedEvent),
+		closed:            make(chan string),
+		watches:           map[string]*namespaceWatch{},
+	}, nil
+}
+
+// namespaces is a helper function to get the namespaces that the PermissionsSnapshot
+// permits the verb for and that are selected by the watch options
+func (nw *namespacedWatch) namespaces(perms *rbac.PermissionsSnapshot, verb string) []string {
+	namespaces := []string{}
+	for _, ns := range getPermittedNamespaces(perms, nw.gvr, verb) {
+		if nw.namespaceSelected && ns != nw.selectedNamespace {
+			continue
+		}
+		namespaces = append(namespaces, ns)
+	}
+	return namespaces
+}
+
+// listGVK is a helper function to get the list GVK of the resource being watched
+func (nw *namespacedWatch) listGVK() schema.GroupVersionKind {
+	return schema.GroupVersionKind{
+		Group:   nw.gvk.Group,
+		Version: nw.gvk.Version,
+		Kind:    getKindList(nw.gvk.Kind),
+	}
+}
+
+// list is a helper function to list the resources being watched in the given namespace
+// that match the label and field selectors of the watch options
+func (nw *namespacedWatch) list(ctx context.Context, namespace string) (*unstructured.UnstructuredList, error) {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(nw.listGVK())
+
+	err := nw.cli.List(ctx, list, &client.ListOptions{
+		Namespace: namespace,
+		Raw: &metav1.ListOptions{
+			LabelSelector: nw.opts.LabelSelector,
+			FieldSelector: nw.opts.FieldSelector,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("encountered an error listing %s in namespace `%s`: %w", list.GetKind(), namespace, err)
+	}
+
+	return list, nil
+}
+
+// addNamespace opens an upstream watch for the given namespace starting at the given
+// resourceVersion and starts forwarding its events to the namespacedWatch events channel.
+// The objects in the namespace that are already known to the client are tracked so that
+// they can be removed from the client's view if access to the namespace is revoked.
+// The progress of the namespace starts no lower than the last bookmark sent to the
+// client so that the resourceVersion of the merged watch never goes backwards.
+func (nw *namespacedWatch) addNamespace(ctx context.Context, namespace string, resourceVersion string, known []unstructured.Unstructured) error {
+	if _, ok := nw.watches[namespace]; ok {
+		return nil
+	}
+
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(nw.listGVK())
+
+	// Bookmarks are always requested so that the progress of a namespace
+	// without any changes doesn't hold back the merged bookmarks
+	opts := nw.opts
+	opts.ResourceVersion = resourceVersion
+	opts.AllowWatchBookmarks = true
+	w, err := nw.cli.Watch(ctx, list, &client.ListOptions{Namespace: namespace, Raw: &opts})
+	if err != nil {
+		return fmt.Errorf("encountered an error watching %s in namespace `%s`: %w", list.GetKind(), namespace, err)
+	}
+
+	progress := parseResourceVersion(resourceVersion)
+	if progress < nw.bookmark {
+		progress = nw.bookmark
+	}
+
+	nsCtx, cancel := context.WithCancel(ctx)
+	nsWatch := &namespaceWatch{
+		watch:    w,
+		cancel:   cancel,
+		objects:  map[string]runtime.Object{},
+		progress: progress,
+	}
+	for i := range known {
+		nsWatch.objects[known[i].GetName()] = &known[i]
+	}
+	nw.watches[namespace] = nsWatch
+
+	go nw.forward(nsCtx, namespace, w)
+	return nil
+}
+
+// removeNamespace stops the upstream watch for the given namespace. It returns the
+// objects from the namespace that were known to the client.
+func (nw *namespacedWatch) removeNamespace(namespace string) []runtime.Object {
+	nsWatch, ok := nw.watches[namespace]
+	if !ok {
+		return nil
+	}
+
+	nsWatch.cancel()
+	nsWatch.watch.Stop()
+	delete(nw.watches, namespace)
+
+	objects := []runtime.Object{}
+	for _, obj := range nsWatch.objects {
+		objects = append(objects, obj)
+	}
+	return objects
+}
+
+// forward is a helper function that sends every event received from the
+// upstream watch to the namespacedWatch events channel until either the
+// upstream watch or the context is closed.
+func (nw *namespacedWatch) forward(ctx context.Context, namespace string, w watch.Interface) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-w.ResultChan():
+			if !ok {
+				select {
+				case nw.closed <- namespace:
+				case <-ctx.Done():
+				}
+				return
+			}
+			select {
+			case nw.events <- namespacedEvent{namespace: namespace, event: e}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// stop stops all of the upstream watches
+func (nw *namespacedWatch) stop() {
+	for ns := range nw.watches {
+		nw.removeNamespace(ns)
+	}
+}
+
+// receive is a helper function that records the progress of a namespace from the given
+// watch.Event and writes the event to the client. Bookmarks from a single namespace are not
+// valid for the merged stream, so they only advance the progress of the namespace and a merged
+// bookmark is written once every namespace has progressed past the last one.
+func (nw *namespacedWatch) receive(rw http.ResponseWriter, namespace string, e watch.Event) error {
+	nsWatch, ok := nw.watches[namespace]
+	if !ok {
+		return nil
+	}
+
+	if rv := eventResourceVersion(e); rv > nsWatch.progress {
+		nsWatch.progress = rv
+	}
+
+	if e.Type != watch.Bookmark {
+		nw.track(namespace, e)
+		if err := writeWatchEvent(rw, e); err != nil {
+			return err
+		}
+	}
+
+	if err := nw.writeBookmark(rw, nw.progress()); err != nil {
+		return err
+	}
+
+	flush(rw)
+	return nil
+}
+
+// progress is a helper function to get the lowest resourceVersion that every
+// watched namespace has received events up to, 0 if no namespace is watched
+func (nw *namespacedWatch) progress() uint64 {
+	var progress uint64
+	first := true
+	for _, nsWatch := range nw.watches {
+		if first || nsWatch.progress < progress {
+			progress = nsWatch.progress
+			first = false
+		}
+	}
+
+	return progress
+}
+
+// track is a helper function that keeps the objects known to the client
+// for a namespace up to date with the given watch.Event
+func (nw *namespacedWatch) track(namespace string, e watch.Event) {
+	nsWatch, ok := nw.watches[namespace]
+	if !ok {
+		return
+	}
+
+	obj, ok := e.Object.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	switch e.Type {
+	case watch.Added, watch.Modified:
+		nsWatch.objects[obj.GetName()] = obj
+	case watch.Deleted:
+		delete(nsWatch.objects, obj.GetName())
+	}
+}
+
+// sync is a helper function that reconciles the upstream watches with the given set of
+// permitted namespaces. Namespaces that are newly permitted have all of their objects sent
+// to the client as ADDED events before a watch is started for them. Namespaces that are
+// no longer permitted have all of their known objects sent to the client as DELETED events
+// and their watch is stopped. If a newly permitted namespace can't be listed or watched an
+// ERROR event is sent to the client and an error is returned, so that the client re-establishes
+// its watch instead of silently missing the events of that namespace.
+func (nw *namespacedWatch) sync(ctx context.Context, rw http.ResponseWriter, namespaces []string) error {
+	permitted := map[string]struct{}{}
+	for _, ns := range namespaces {
+		permitted[ns] = struct{}{}
+	}
+
+	for ns := range nw.watches {
+		if _, ok := permitted[ns]; ok {
+			continue
+		}
+
+		klog.V(0).Infof("access to namespace `%s` revoked, removing it from the watch stream", ns)
+		for _, obj := range nw.removeNamespace(ns) {
+			if err := writeWatchEvent(rw, watch.Event{Type: watch.Deleted, Object: obj}); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, ns := range namespaces {
+		if _, ok := nw.watches[ns]; ok {
+			continue
+		}
+
+		klog.V(0).Infof("access to namespace `%s` granted, adding it to the watch stream", ns)
+		list, err := nw.list(ctx, ns)
+		if err != nil {
+			return writeWatchError(rw, err)
+		}
+
+		for i := range list.Items {
+			if err := writeWatchEvent(rw, watch.Event{Type: watch.Added, Object: &list.Items[i]}); err != nil {
+				return err
+			}
+		}
+
+		if err := nw.addNamespace(ctx, ns, list.GetResourceVersion(), list.Items); err != nil {
+			return writeWatchError(rw, err)
+		}
+	}
+
+	// The progress of the watch may have changed with the namespaces
+	if err := nw.writeBookmark(rw, nw.progress()); err != nil {
+		return err
+	}
+
+	flush(rw)
+	return nil
+}
+
+// writeWatchError is a helper function that writes the given error to the client
+// as an ERROR event and returns it, or the error encountered writing the event
+func writeWatchError(rw http.ResponseWriter, err error) error {
+	status := statusForError(err)
+	status.Kind = "Status"
+	status.APIVersion = "v1"
+	if writeErr := writeWatchEvent(rw, watch.Event{Type: watch.Error, Object: status}); writeErr != nil {
+		return writeErr
+	}
+
+	flush(rw)
+	return err
+}
+
+// serve writes the multiplexed events to the http.ResponseWriter as a watch stream.
+// It blocks until the context is closed or one of the upstream watches is closed.
+// When an upstream watch closes the whole stream is ended so that the client
+// re-establishes its watch instead of silently missing events for that namespace.
+// Every time the permissions of the Authorizer may have changed the set of watched
+// namespaces is reconciled with the namespaces that are permitted the given verb.
+// The given initial events are written before any event of the upstream watches.
+func (nw *namespacedWatch) serve(ctx context.Context, rw http.ResponseWriter, authz Authorizer, verb string, initial []watch.Event) {
+	changes, unsubscribe := authz.Subscribe()
+	defer unsubscribe()
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	for _, e := range initial {
+		if err := writeWatchEvent(rw, e); err != nil {
+			klog.V(0).ErrorS(err, "encountered an error writing watch event to client")
+			return
+		}
+	}
+	flush(rw)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changes:
+			perms, err := authz.ForRequest().Permissions(ctx)
+			if err != nil {
+				klog.V(0).ErrorS(err, "encountered an error getting the permissions for namespace watch")
+				continue
+			}
+			// the watches of namespaces whose permissions could not be discovered are kept
+			namespaces := nw.namespaces(perms, verb)
+			for ns := range perms.FailedNamespaces {
+				if _, ok := nw.watches[ns]; ok {
+					namespaces = append(namespaces, ns)
+				}
+			}
+			if err := nw.sync(ctx, rw, namespaces); err != nil {
+				klog.V(0).ErrorS(err, "encountered an error writing watch event to client")
+				return
+			}
+		case ns := <-nw.closed:
+			if _, ok := nw.watches[ns]; !ok { // the namespace was removed from the stream
+				continue
+			}
+			klog.V(0).Infof("watch for namespace `%s` closed, ending the watch stream", ns)
+			return
+		case e := <-nw.events:
+			if _, ok := nw.watches[e.namespace]; !ok { // the namespace was removed from the stream
+				continue
+			}
+			// An error means that the events of the namespace can't be received
+			// anymore, so the client has to re-establish its watch
+			if e.event.Type == watch.Error {
+				klog.V(0).Infof("watch for namespace `%s` failed, ending the watch stream", e.namespace)
+				if err := writeWatchEvent(rw, e.event); err != nil {
+					klog.V(0).ErrorS(err, "encountered an error writing watch event to client")
+				}
+				flush(rw)
+				return
+			}
+			if err := nw.receive(rw, e.namespace, e.event); err != nil {
+				klog.V(0).ErrorS(err, "encountered an error writing watch event to client")
+				return
+			}
+		}
+	}
+}
+
+// writeBookmark is a helper function that sends a bookmark for the given progress to the
+// client if it requested bookmarks and the progress is past the last bookmark. The progress
+// is the lowest resourceVersion that all of the namespaces have received events up to, so
+// resuming the merged watch from it can't skip events.
+func (nw *namespacedWatch) writeBookmark(rw http.ResponseWriter, progress uint64) error {
+	if !nw.opts.AllowWatchBookmarks || len(nw.watches) == 0 || progress <= nw.bookmark {
+		return nil
+	}
+	nw.bookmark = progress
+
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(nw.gvk)
+	obj.SetResourceVersion(strconv.FormatUint(progress, 10))
+	return writeWatchEvent(rw, watch.Event{Type: watch.Bookmark, Object: obj})
+}
+
+// parseResourceVersion is a helper function to parse a resourceVersion
+// so that it can be compared. Returns 0 if it can't be parsed.
+func parseResourceVersion(resourceVersion string) uint64 {
+	rv, err := strconv.ParseUint(resourceVersion, 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return rv
+}
+
+// eventResourceVersion is a helper function to get the parsed resourceVersion of
+// the object of a watch.Event. Returns 0 if the object has no resourceVersion.
+func eventResourceVersion(e watch.Event) uint64 {
+	obj, err := meta.Accessor(e.Object)
+	if err != nil {
+		return 0
+	}
+
+	return parseResourceVersion(obj.GetResourceVersion())
+}
+
+// writeWatchEvent is a helper function to write a watch.Event to the
+// http.ResponseWriter framed as a newline delimited metav1.WatchEvent
+func writeWatchEvent(rw http.ResponseWriter, e watch.Event) error {
+	raw, err := json.Marshal(e.Object)
+	if err != nil {
+		return fmt.Errorf("encountered an error marshalling watch event object: %w", err)
+	}
+
+	return json.NewEncoder(rw).Encode(&metav1.WatchEvent{
+		Type:   string(e.Type),
+		Object: runtime.RawExtension{Raw: raw},
+	})
+}
+
+// flush is a helper function to flush any buffered data to the client
+func flush(rw http.ResponseWriter) {
+	if f, ok := rw.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// watchNamespacedResources is a helper function that when given a http.ResponseWriter,
+// http.Request, client.WithWatch, GroupVersionKind, Authorizer, the RequestAuthorizer of the
+// request, and a verb will open a watch for the GVK in every namespace that the permissions
+// of the RequestAuthorizer include the permission verb for and write
+// the events of all of them to the client as a single watch stream. Namespaces are
+// added to and removed from the stream as the permissions of the Authorizer change.
+// This function is blocking until the watch stream is ended.
+func watchNamespacedResources(rw http.ResponseWriter, req *http.Request, cli client.WithWatch, gvk schema.GroupVersionKind, authz Authorizer, requestAuthz RequestAuthorizer, verb string) {
+	opts, err := listOptionsFromRequest(req.URL)
+	if err != nil {
+		writeStatus(rw, &apierrors.NewBadRequest(err.Error()).ErrStatus)
+		return
+	}
+	opts.Watch = true
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if opts.TimeoutSeconds != nil {
+		ctx, cancel = context.WithTimeout(req.Context(), time.Duration(*opts.TimeoutSeconds)*time.Second)
+	} else {
+		ctx, cancel = context.WithCancel(req.Context())
+	}
+	defer cancel()
+
+	gvr, err := getResourceForKind(cli.RESTMapper(), gvk)
+	if err != nil {
+		klog.V(0).ErrorS(err, "encountered an error starting namespaced watch")
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	nw, err := newNamespacedWatch(cli, gvk, gvr, opts)
+	if err != nil {
+		writeStatus(rw, &apierrors.NewBadRequest(err.Error()).ErrStatus)
+		return
+	}
+	defer nw.stop()
+
+	perms, err := requestAuthz.Permissions(ctx)
+	if err != nil {
+		writeStatus(rw, statusForError(err))
+		return
+	}
+
+	// a namespace whose permissions could not be discovered would silently be missing from the stream
+	failures, err := getPermissionFailures(perms, opts.FieldSelector)
+	if err != nil {
+		writeStatus(rw, &apierrors.NewBadRequest(err.Error()).ErrStatus)
+		return
+	}
+	if len(failures) > 0 {
+		writeStatus(rw, statusForNamespaceFailures(failures))
+		return
+	}
+
+	// Without a resourceVersion the client expects the current state as ADDED events. They are
+	// sent from the initial lists and every namespace is watched from the resourceVersion of its
+	// list, so that the progress of every namespace is known from the start of the stream.
+	sendInitial := opts.ResourceVersion == "" || opts.ResourceVersion == "0"
+	initial := []watch.Event{}
+	for _, ns := range nw.namespaces(perms, verb) {
+		// The objects already known to the client are needed in the event
+		// that access to the namespace is revoked while the stream is open
+		list, err := nw.list(ctx, ns)
+		if err != nil {
+			writeStatus(rw, statusForError(err))
+			return
+		}
+
+		resourceVersion := opts.ResourceVersion
+		if sendInitial {
+			resourceVersion = list.GetResourceVersion()
+			for i := range list.Items {
+				initial = append(initial, watch.Event{Type: watch.Added, Object: &list.Items[i]})
+			}
+		}
+
+		// The client needs to relist when the resourceVersion it is watching from is too old,
+		// and a namespace that can't be watched would silently be missing from the stream
+		if err := nw.addNamespace(ctx, ns, resourceVersion, list.Items); err != nil {
+			writeStatus(rw, statusForError(err))
+			return
+		}
+	}
+
+	nw.serve(ctx, rw, authz, verb, initial)
+}
@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// newTestEvent is a helper function to create a watch.Event for a pod with the given name and resourceVersion
+func newTestEvent(eventType watch.EventType, name string, resourceVersion string) watch.Event {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("Pod")
+	obj.SetName(name)
+	obj.SetResourceVersion(resourceVersion)
+	return watch.Event{Type: eventType, Object: obj}
+}
+
+// writtenEvents is a helper function to get the type and resourceVersion of every event written to the recorder
+func writtenEvents(t *testing.T, rw *httptest.ResponseRecorder) []string {
+	t.Helper()
+
+	events := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(rw.Body.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		e := &metav1.WatchEvent{}
+		if err := json.Unmarshal([]byte(line), e); err != nil {
+			t.Fatalf("unexpected error decoding watch event: %v", err)
+		}
+		obj := &unstructured.Unstructured{}
+		if err := json.Unmarshal(e.Object.Raw, obj); err != nil {
+			t.Fatalf("unexpected error decoding watch event object: %v", err)
+		}
+		events = append(events, e.Type+"@"+obj.GetResourceVersion())
+	}
+	rw.Body.Reset()
+	return events
+}
+
+func TestNamespacedWatchSendsEventsAndGatesBookmarks(t *testing.T) {
+	nw := &namespacedWatch{
+		gvk:      schema.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		opts:     metav1.ListOptions{AllowWatchBookmarks: true},
+		bookmark: 10,
+		watches: map[string]*namespaceWatch{
+			"a": {objects: map[string]runtime.Object{}, progress: 10},
+			"b": {objects: map[string]runtime.Object{}, progress: 10},
+		},
+	}
+	rw := httptest.NewRecorder()
+
+	// the events of a are sent even though namespace b has not progressed past 10
+	for _, e := range []watch.Event{newTestEvent(watch.Added, "a-1", "12"), newTestEvent(watch.Modified, "a-1", "15")} {
+		if err := nw.receive(rw, "a", e); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if events, want := writtenEvents(t, rw), []string{"ADDED@12", "MODIFIED@15"}; !reflect.DeepEqual(events, want) {
+		t.Fatalf("expected events %v, got %v", want, events)
+	}
+
+	// an event of b at 13 moves the merged bookmark up to 13
+	if err := nw.receive(rw, "b", newTestEvent(watch.Added, "b-1", "13")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if events, want := writtenEvents(t, rw), []string{"ADDED@13", "BOOKMARK@13"}; !reflect.DeepEqual(events, want) {
+		t.Fatalf("expected events %v, got %v", want, events)
+	}
+
+	// a bookmark of b is not sent itself, it moves the merged bookmark up to the progress of a
+	if err := nw.receive(rw, "b", newTestEvent(watch.Bookmark, "", "20")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if events, want := writtenEvents(t, rw), []string{"BOOKMARK@15"}; !reflect.DeepEqual(events, want) {
+		t.Fatalf("expected events %v, got %v", want, events)
+	}
+
+	if _, ok := nw.watches["a"].objects["a-1"]; !ok {
+		t.Fatalf("expected the sent object of namespace a to be tracked")
+	}
+}
+
+func TestNamespacedWatchAddNamespaceStartsAtLastBookmark(t *testing.T) {
+	nw, err := newNamespacedWatch(newTestClients().Client, schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, schema.GroupVersionResource{Version: "v1", Resource: "pods"}, metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer nw.stop()
+	nw.bookmark = 20
+
+	if err := nw.addNamespace(context.Background(), "a", "5", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := nw.addNamespace(context.Background(), "b", "25", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if progress := nw.watches["a"].progress; progress != 20 {
+		t.Fatalf("expected the progress of a namespace listed before the last bookmark to be 20, got %d", progress)
+	}
+	if progress := nw.watches["b"].progress; progress != 25 {
+		t.Fatalf("expected the progress of a namespace listed after the last bookmark to be 25, got %d", progress)
+	}
+}
+
+func TestNamespacedWatchSyncRemovesNamespace(t *testing.T) {
+	b1 := newTestEvent(watch.Added, "b-1", "8").Object
+	nw := &namespacedWatch{
+		gvk:      schema.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		opts:     metav1.ListOptions{AllowWatchBookmarks: true},
+		bookmark: 10,
+		watches: map[string]*namespaceWatch{
+			"a": {objects: map[string]runtime.Object{}, progress: 15},
+			"b": {objects: map[string]runtime.Object{"b-1": b1}, progress: 10, watch: watch.NewEmptyWatch(), cancel: func() {}},
+		},
+	}
+	rw := httptest.NewRecorder()
+
+	// the objects of b are deleted and b no longer holds back the merged bookmark
+	if err := nw.sync(context.Background(), rw, []string{"a"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if events, want := writtenEvents(t, rw), []string{"DELETED@8", "BOOKMARK@15"}; !reflect.DeepEqual(events, want) {
+		t.Fatalf("expected events %v, got %v", want, events)
+	}
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/everettraven/rbac-proxy-poc/internal/handler"
+	"github.com/everettraven/rbac-proxy-poc/internal/rbac"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/transport"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// tokenReviewCacheTTL is how long the identity of an authenticated bearer token is cached
+const tokenReviewCacheTTL = time.Minute
+
+// Impersonation is how the FilterServer serves many callers while running with its own
+// privileged identity. The bearer token of each caller is authenticated, the permissions
+// of the resolved identity are decided by its own Authorizer, and requests are made as
+// the caller by using the Kubernetes impersonation headers.
+type Impersonation struct {
+	// The authenticator used to resolve the identity of a caller
+	Authenticator *TokenReviewAuthenticator
+	// The Authorizers for the identities of the callers
+	Authorizers handler.IdentityAuthorizers
+}
+
+// cachedIdentity is the identity of an authenticated bearer token
+type cachedIdentity struct {
+	// The identity of the bearer token
+	identity rbac.Identity
+	// When the identity must be authenticated again
+	expires time.Time
+}
+
+// TokenReviewAuthenticator authenticates the bearer token of a request with a TokenReview.
+// The identities of authenticated bearer tokens are cached for a short amount of time.
+type TokenReviewAuthenticator struct {
+	// The client used to create TokenReviews
+	client client.Client
+
+	// The lock for the identities
+	mu sync.Mutex
+	// The identities of authenticated bearer tokens keyed by the hash of the token
+	identities map[string]cachedIdentity
+}
+
+// NewTokenReviewAuthenticator creates a new TokenReviewAuthenticator
+// that creates TokenReviews with the given client.Client
+func NewTokenReviewAuthenticator(cli client.Client) *TokenReviewAuthenticator {
+	return &TokenReviewAuthenticator{
+		client:     cli,
+		identities: map[string]cachedIdentity{},
+	}
+}
+
+// Authenticate resolves the identity of the caller of the given http.Request from its
+// bearer token. It returns an Unauthorized error if the request has no bearer token
+// or the bearer token is not authenticated by the Kubernetes API server.
+func (a *TokenReviewAuthenticator) Authenticate(ctx context.Context, req *http.Request) (rbac.Identity, error) {
+	token, ok := bearerToken(req)
+	if !ok {
+		return rbac.Identity{}, apierrors.NewUnauthorized("a bearer token is required")
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+	if identity, ok := a.cached(key); ok {
+		return identity, nil
+	}
+
+	review := &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	}
+	if err := a.client.Create(ctx, review); err != nil {
+		return rbac.Identity{}, fmt.Errorf("encountered an error creating a TokenReview: %w", err)
+	}
+	if !review.Status.Authenticated {
+		message := "the bearer token is not authenticated"
+		if review.Status.Error != "" {
+			message = fmt.Sprintf("%s: %s", message, review.Status.Error)
+		}
+		return rbac.Identity{}, apierrors.NewUnauthorized(message)
+	}
+
+	identity := rbac.Identity{
+		User:   review.Status.User.Username,
+		Groups: review.Status.User.Groups,
+	}
+	if len(review.Status.User.Extra) > 0 {
+		identity.Extra = map[string][]string{}
+		for k, v := range review.Status.User.Extra {
+			identity.Extra[k] = v
+		}
+	}
+
+	a.cache(key, identity)
+	return identity, nil
+}
+
+// cached is a helper function to get the cached identity for the given
+// key, with a bool that is false if there is no unexpired identity
+func (a *TokenReviewAuthenticator) cached(key string) (rbac.Identity, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	cached, ok := a.identities[key]
+	if !ok || time.Now().After(cached.expires) {
+		return rbac.Identity{}, false
+	}
+
+	return cached.identity, true
+}
+
+// cache is a helper function to cache the identity for the given key.
+// Expired identities are removed whenever a new identity is cached.
+func (a *TokenReviewAuthenticator) cache(key string, identity rbac.Identity) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	for k, cached := range a.identities {
+		if now.After(cached.expires) {
+			delete(a.identities, k)
+		}
+	}
+
+	a.identities[key] = cachedIdentity{identity: identity, expires: now.Add(tokenReviewCacheTTL)}
+}
+
+// bearerToken is a helper function to get the bearer token from the Authorization
+// header of the http.Request, with a bool that is false if there is none
+func bearerToken(req *http.Request) (string, bool) {
+	parts := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") {
+		return "", false
+	}
+
+	token := strings.TrimSpace(parts[1])
+	return token, token != ""
+}
+
+// impersonate is a helper function to resolve the handler.Authorizer and handler.Clients for the
+// caller of the http.Request and to replace the credentials of the request with impersonation
+// headers for the caller, so the request is proxied with the credentials of the proxy. It
+// responds to the request and returns a bool that is false if the caller can't be impersonated.
+func (f *FilterServer) impersonate(rw http.ResponseWriter, req *http.Request) (handler.Authorizer, *handler.Clients, bool) {
+	identity, err := f.Impersonation.Authenticator.Authenticate(req.Context(), req)
+	if err != nil {
+		handler.HandleError(rw, req, err)
+		return nil, nil, false
+	}
+
+	authz, err := f.Impersonation.Authorizers.AuthorizerFor(req.Context(), identity)
+	if err != nil {
+		handler.HandleError(rw, req, err)
+		return nil, nil, false
+	}
+
+	clients, err := f.Clients.Impersonating(identity)
+	if err != nil {
+		handler.HandleError(rw, req, err)
+		return nil, nil, false
+	}
+
+	setImpersonationHeaders(req, identity)
+	return authz, clients, true
+}
+
+// setImpersonationHeaders is a helper function to replace the credentials and any
+// impersonation headers sent by the caller of the http.Request with the impersonation
+// headers for the given identity
+func setImpersonationHeaders(req *http.Request, identity rbac.Identity) {
+	req.Header.Del("Authorization")
+	for header := range req.Header {
+		if strings.HasPrefix(header, "Impersonate-") {
+			req.Header.Del(header)
+		}
+	}
+
+	req.Header.Set(transport.ImpersonateUserHeader, identity.User)
+	for _, group := range identity.Groups {
+		req.Header.Add(transport.ImpersonateGroupHeader, group)
+	}
+	for key, values := range identity.Extra {
+		for _, value := range values {
+			req.Header.Add(transport.ImpersonateUserExtraHeaderPrefix+url.PathEscape(key), value)
+		}
+	}
+}
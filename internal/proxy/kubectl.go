@@ -11,7 +11,6 @@ import (
 	"time"
 
 	"github.com/everettraven/rbac-proxy-poc/internal/handler"
-	"github.com/everettraven/rbac-proxy-poc/internal/rbac"
 	utilnet "k8s.io/apimachinery/pkg/util/net"
 	k8sproxy "k8s.io/apimachinery/pkg/util/proxy"
 	"k8s.io/client-go/rest"
@@ -44,7 +43,14 @@ type FilterServer struct {
 	// The delegate to call to handle accepted requests.
 	delegate http.Handler
 
-	PermissionsWatcher *rbac.RBACWatcher
+	// The Authorizer that decides what accepted requests are permitted to do
+	Authorizer handler.Authorizer
+	// The clients shared by the handling of every accepted request
+	Clients *handler.Clients
+	// How callers are impersonated, nil if every request is handled as the identity of the proxy
+	Impersonation *Impersonation
+	// The options used to handle accepted requests
+	HandlerOptions handler.Options
 }
 
 // MakeRegexpArray splits a comma separated list of regexps into an array of Regexp objects.
@@ -113,12 +119,34 @@ func extractHost(header string) (host string) {
 	return host
 }
 
+// hasSynced returns whether or not the authorizers used to handle requests have synced
+func (f *FilterServer) hasSynced() bool {
+	if f.Impersonation != nil {
+		return f.Impersonation.Authorizers.HasSynced()
+	}
+
+	return f.Authorizer.HasSynced()
+}
+
 func (f *FilterServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	host := extractHost(req.Host)
 	if f.accept(req.Method, req.URL.Path, host) {
 		klog.V(0).Infof("Filter accepting %v %v %v", req.Method, req.URL.Path, host)
+		// Requests can't be handled correctly until the permissions have synced
+		if !f.hasSynced() {
+			handler.HandleNotReady(rw, req)
+			return
+		}
+		authz, clients := f.Authorizer, f.Clients
+		if f.Impersonation != nil {
+			var ok bool
+			authz, clients, ok = f.impersonate(rw, req)
+			if !ok {
+				return
+			}
+		}
 		// Intercept the request
-		direct := handler.HandleRequest(rw, req, f.PermissionsWatcher)
+		direct := handler.HandleRequest(rw, req, authz, clients, f.HandlerOptions)
 		if direct {
 			f.delegate.ServeHTTP(rw, req)
 		}
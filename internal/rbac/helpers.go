@@ -5,65 +5,198 @@ import (
 	"fmt"
 	"strings"
 
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
 	rbac "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/rest"
 	"k8s.io/klog"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 // getPermissionsForClusterRoleBinding is a helper function that will
 // fetch the Permissions for a given ClusterRoleBinding resource. It accepts
-// a client.Client and rbac.ClusterRoleBinding as parameters and returns a Permissions
-func getPermissionsForClusterRoleBinding(cli client.Client, crb *rbac.ClusterRoleBinding) Permissions {
+// a client.Reader and rbac.ClusterRoleBinding as parameters and returns a Permissions
+func getPermissionsForClusterRoleBinding(cli client.Reader, crb *rbac.ClusterRoleBinding) Permissions {
 	perms := Permissions{}
 	cr := &rbac.ClusterRole{}
 	err := cli.Get(context.Background(), client.ObjectKey{Name: crb.RoleRef.Name}, cr)
 	if err != nil {
-		klog.V(0).Infof(fmt.Sprintf("encountered an error attempting to get ClusterRole with name: %s", &crb.RoleRef.Name))
+		klog.V(0).Infof(fmt.Sprintf("encountered an error attempting to get ClusterRole with name: %s", crb.RoleRef.Name))
 	}
-	if len(cr.Rules) > 0 {
+	rules := getRulesForClusterRole(cli, cr)
+	if len(rules) > 0 {
 		klog.V(0).Infof(fmt.Sprintf("processing ClusterRole %s", cr.Name))
-
-		for _, rule := range cr.Rules {
-			verbsMap := make(map[string]interface{})
-			for _, verb := range rule.Verbs {
-				verbsMap[verb] = 0
-			}
-			for _, res := range rule.Resources {
-				klog.V(0).Infof(fmt.Sprintf("ClusterRole `%s` sets resource `%s` with verbs `%s`", cr.Name, res, strings.Join(rule.Verbs, ",")))
-				perms[res] = verbsMap
-			}
-		}
+		perms = getPermissionsForRules("ClusterRole", cr.Name, rules)
 	}
 
-	klog.V(0).Infof("PERMS -- ", perms)
+	klog.V(0).Infof("PERMS -- %v", perms)
 	return perms
 }
 
 // getPermissionsForRoleBinding is a helper function that will
 // fetch the Permissions for a given RoleBinding resource. It accepts
-// a client.Client and rbac.RoleBinding as parameters and returns a Permissions
-func getPermissionsForRoleBinding(cli client.Client, rb *rbac.RoleBinding) Permissions {
+// a client.Reader and rbac.RoleBinding as parameters and returns a Permissions.
+// A RoleBinding can reference either a Role in its own namespace or a ClusterRole,
+// in both cases the Permissions only apply to the namespace of the RoleBinding.
+func getPermissionsForRoleBinding(cli client.Reader, rb *rbac.RoleBinding) Permissions {
 	perms := Permissions{}
-	role := &rbac.Role{}
-	err := cli.Get(context.Background(), client.ObjectKey{Name: rb.RoleRef.Name, Namespace: rb.Namespace}, role)
-	if err != nil {
-		klog.V(0).Infof(fmt.Sprintf("encountered an error attempting to get Role with name: %s", rb.RoleRef.Name))
+	var rules []rbac.PolicyRule
+
+	switch rb.RoleRef.Kind {
+	case "ClusterRole":
+		cr := &rbac.ClusterRole{}
+		err := cli.Get(context.Background(), client.ObjectKey{Name: rb.RoleRef.Name}, cr)
+		if err != nil {
+			klog.V(0).Infof(fmt.Sprintf("encountered an error attempting to get ClusterRole with name: %s", rb.RoleRef.Name))
+			return nil
+		}
+		rules = getRulesForClusterRole(cli, cr)
+	case "Role":
+		role := &rbac.Role{}
+		err := cli.Get(context.Background(), client.ObjectKey{Name: rb.RoleRef.Name, Namespace: rb.Namespace}, role)
+		if err != nil {
+			klog.V(0).Infof(fmt.Sprintf("encountered an error attempting to get Role with name: %s", rb.RoleRef.Name))
+			return nil
+		}
+		rules = role.Rules
+	default:
+		klog.V(0).Infof(fmt.Sprintf("RoleBinding `%s/%s` references unknown role kind: %s", rb.Namespace, rb.Name, rb.RoleRef.Kind))
 		return nil
 	}
-	if len(role.Rules) > 0 {
-		klog.V(0).Infof(fmt.Sprintf("processing Role %s", role.Name))
-		for _, rule := range role.Rules {
-			verbsMap := make(map[string]interface{})
-			for _, verb := range rule.Verbs {
-				verbsMap[verb] = 0
-			}
+
+	if len(rules) > 0 {
+		klog.V(0).Infof(fmt.Sprintf("processing %s %s", rb.RoleRef.Kind, rb.RoleRef.Name))
+		perms = getPermissionsForRules(rb.RoleRef.Kind, rb.RoleRef.Name, rules)
+	}
+
+	klog.V(0).Infof("PERMS -- %v", perms)
+	return perms
+}
+
+// getPermissionsForRules is a helper function that will convert the
+// rules of a Role or ClusterRole into Permissions. It accepts the kind
+// and name of the role for logging purposes and a list of rbac.PolicyRule
+// and returns a Permissions keyed by the group and resource of each rule.
+func getPermissionsForRules(kind string, name string, rules []rbac.PolicyRule) Permissions {
+	perms := Permissions{}
+	for _, rule := range rules {
+		for _, group := range rule.APIGroups {
 			for _, res := range rule.Resources {
-				klog.V(0).Infof(fmt.Sprintf("Role `%s` sets resource `%s` with verbs `%s`", role.Name, res, strings.Join(rule.Verbs, ",")))
-				perms[res] = verbsMap
+				klog.V(5).Infof(fmt.Sprintf("%s `%s` sets resource `%s` in group `%s` with verbs `%s`", kind, name, res, group, strings.Join(rule.Verbs, ",")))
+				key := PermissionsKey(group, res)
+				if _, ok := perms[key]; !ok {
+					perms[key] = make(map[string]ResourceNames)
+				}
+
+				// A rule with resourceNames only grants the verbs for those names
+				var names ResourceNames
+				if len(rule.ResourceNames) > 0 {
+					names = ResourceNames{}
+					for _, name := range rule.ResourceNames {
+						names[name] = struct{}{}
+					}
+				}
+
+				for _, verb := range rule.Verbs {
+					if existing, ok := perms[key][verb]; ok {
+						perms[key][verb] = mergeResourceNames(existing, names)
+					} else {
+						perms[key][verb] = names
+					}
+				}
 			}
 		}
 	}
 
-	klog.V(0).Infof("PERMS -- ", perms)
 	return perms
 }
+
+// getRulesForClusterRole is a helper function to get the rules of a ClusterRole.
+// The rules of an aggregated ClusterRole are the rules of every other ClusterRole
+// that matches one of its aggregation label selectors, the same way that the
+// controller-manager fills them in. It accepts a client.Reader that is used to
+// list the ClusterRoles and a rbac.ClusterRole and returns a list of rbac.PolicyRule
+func getRulesForClusterRole(reader client.Reader, cr *rbac.ClusterRole) []rbac.PolicyRule {
+	if cr.AggregationRule == nil {
+		return cr.Rules
+	}
+
+	crList := &rbac.ClusterRoleList{}
+	err := reader.List(context.Background(), crList)
+	if err != nil {
+		klog.V(0).Infof(fmt.Sprintf("encountered an error attempting to list ClusterRoles for aggregated ClusterRole %s: %v", cr.Name, err))
+		return cr.Rules
+	}
+
+	rules := []rbac.PolicyRule{}
+	for _, other := range crList.Items {
+		if other.Name == cr.Name {
+			continue
+		}
+		if matchesAggregationRule(cr.AggregationRule, other.Labels) {
+			klog.V(0).Infof(fmt.Sprintf("ClusterRole `%s` is aggregated into ClusterRole `%s`", other.Name, cr.Name))
+			rules = append(rules, other.Rules...)
+		}
+	}
+
+	return rules
+}
+
+// matchesAggregationRule is a helper function to determine if a set of ClusterRole
+// labels matches any of the label selectors of an rbac.AggregationRule. Returns a
+// bool that is true if the labels match and false if they do not
+func matchesAggregationRule(rule *rbac.AggregationRule, lbls map[string]string) bool {
+	if rule == nil {
+		return false
+	}
+
+	for _, sel := range rule.ClusterRoleSelectors {
+		selector, err := metav1.LabelSelectorAsSelector(&sel)
+		if err != nil {
+			klog.V(0).Infof(fmt.Sprintf("encountered an error parsing aggregation label selector: %v", err))
+			continue
+		}
+		if selector.Matches(labels.Set(lbls)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsActiveNamespace determines if a Namespace is not terminating. Returns a
+// bool that is true if the Namespace is active and false if it is terminating
+func IsActiveNamespace(ns *corev1.Namespace) bool {
+	return ns.DeletionTimestamp == nil && ns.Status.Phase != corev1.NamespaceTerminating
+}
+
+// canWatchNamespaces is a helper function to determine if the identity of the
+// rest.Config is permitted to list and watch the Namespaces of the cluster.
+// Returns a bool that is true if it is permitted and false if it is not or
+// if that can't be determined
+func canWatchNamespaces(ctx context.Context, cfg *rest.Config) bool {
+	cli, err := client.New(cfg, client.Options{})
+	if err != nil {
+		klog.V(0).Infof("encountered an error creating a client: %v", err)
+		return false
+	}
+
+	for _, verb := range []string{"list", "watch"} {
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{Verb: verb, Version: "v1", Resource: "namespaces"},
+			},
+		}
+		if err := cli.Create(ctx, review); err != nil {
+			klog.V(0).Infof("encountered an error creating a SelfSubjectAccessReview: %v", err)
+			return false
+		}
+		if !review.Status.Allowed {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,143 @@
+package rbac
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	rbac "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestGetPermissionsForRules(t *testing.T) {
+	rules := []rbac.PolicyRule{
+		{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}, ResourceNames: []string{"a"}},
+		{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get", "list"}, ResourceNames: []string{"b"}},
+		{APIGroups: []string{"", "apps"}, Resources: []string{"configmaps", "deployments"}, Verbs: []string{"watch"}},
+		{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"watch"}, ResourceNames: []string{"c"}},
+	}
+
+	expected := Permissions{
+		PermissionsKey("", "pods"):            {"get": ResourceNames{"a": {}, "b": {}}, "list": ResourceNames{"b": {}}},
+		PermissionsKey("", "configmaps"):      {"watch": nil},
+		PermissionsKey("", "deployments"):     {"watch": nil},
+		PermissionsKey("apps", "configmaps"):  {"watch": nil},
+		PermissionsKey("apps", "deployments"): {"watch": nil},
+	}
+	if perms := getPermissionsForRules("Role", "test", rules); !reflect.DeepEqual(perms, expected) {
+		t.Fatalf("expected %v, got %v", expected, perms)
+	}
+}
+
+func TestGetRulesForClusterRole(t *testing.T) {
+	podRule := rbac.PolicyRule{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"list"}}
+	nodeRule := rbac.PolicyRule{APIGroups: []string{""}, Resources: []string{"nodes"}, Verbs: []string{"list"}}
+	secretRule := rbac.PolicyRule{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"list"}}
+
+	aggregated := &rbac.ClusterRole{
+		ObjectMeta: metav1.ObjectMeta{Name: "aggregated", Labels: map[string]string{"aggregate": "true"}},
+		AggregationRule: &rbac.AggregationRule{ClusterRoleSelectors: []metav1.LabelSelector{
+			{MatchLabels: map[string]string{"aggregate": "true"}},
+		}},
+		Rules: []rbac.PolicyRule{secretRule},
+	}
+	cli := fake.NewClientBuilder().WithObjects(
+		aggregated,
+		&rbac.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: "pods", Labels: map[string]string{"aggregate": "true"}}, Rules: []rbac.PolicyRule{podRule}},
+		&rbac.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: "nodes"}, Rules: []rbac.PolicyRule{nodeRule}},
+	).Build()
+
+	// the rules of an aggregated ClusterRole come from the ClusterRoles that match its selectors
+	if rules := getRulesForClusterRole(cli, aggregated); !reflect.DeepEqual(rules, []rbac.PolicyRule{podRule}) {
+		t.Fatalf("expected the rules of the aggregated ClusterRole to be %v, got %v", []rbac.PolicyRule{podRule}, rules)
+	}
+
+	plain := &rbac.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: "nodes"}, Rules: []rbac.PolicyRule{nodeRule}}
+	if rules := getRulesForClusterRole(cli, plain); !reflect.DeepEqual(rules, []rbac.PolicyRule{nodeRule}) {
+		t.Fatalf("expected the rules of the ClusterRole to be %v, got %v", []rbac.PolicyRule{nodeRule}, rules)
+	}
+}
+
+func TestMatchesAggregationRule(t *testing.T) {
+	rule := &rbac.AggregationRule{ClusterRoleSelectors: []metav1.LabelSelector{
+		{MatchLabels: map[string]string{"a": "true"}},
+		{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "b", Operator: metav1.LabelSelectorOpExists}}},
+	}}
+
+	tests := []struct {
+		name    string
+		rule    *rbac.AggregationRule
+		labels  map[string]string
+		matches bool
+	}{
+		{name: "first selector", rule: rule, labels: map[string]string{"a": "true"}, matches: true},
+		{name: "second selector", rule: rule, labels: map[string]string{"b": "anything"}, matches: true},
+		{name: "no selector", rule: rule, labels: map[string]string{"a": "false"}, matches: false},
+		{name: "no labels", rule: rule, labels: nil, matches: false},
+		{name: "no rule", rule: nil, labels: map[string]string{"a": "true"}, matches: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if matches := matchesAggregationRule(tt.rule, tt.labels); matches != tt.matches {
+				t.Fatalf("expected matches to be %t, got %t", tt.matches, matches)
+			}
+		})
+	}
+}
+
+func TestGetPermissionsForRoleBinding(t *testing.T) {
+	cli := fake.NewClientBuilder().WithObjects(
+		&rbac.Role{
+			ObjectMeta: metav1.ObjectMeta{Name: "role", Namespace: "default"},
+			Rules:      []rbac.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"list"}}},
+		},
+		&rbac.ClusterRole{
+			ObjectMeta: metav1.ObjectMeta{Name: "cluster-role"},
+			Rules:      []rbac.PolicyRule{{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"get"}}},
+		},
+	).Build()
+
+	tests := []struct {
+		name     string
+		roleRef  rbac.RoleRef
+		expected Permissions
+	}{
+		{name: "Role", roleRef: rbac.RoleRef{Kind: "Role", Name: "role"}, expected: Permissions{PermissionsKey("", "pods"): {"list": nil}}},
+		{name: "ClusterRole", roleRef: rbac.RoleRef{Kind: "ClusterRole", Name: "cluster-role"}, expected: Permissions{PermissionsKey("", "secrets"): {"get": nil}}},
+		{name: "missing Role", roleRef: rbac.RoleRef{Kind: "Role", Name: "missing"}, expected: nil},
+		{name: "unknown kind", roleRef: rbac.RoleRef{Kind: "Unknown", Name: "role"}, expected: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rb := &rbac.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "rb", Namespace: "default"}, RoleRef: tt.roleRef}
+			if perms := getPermissionsForRoleBinding(cli, rb); !reflect.DeepEqual(perms, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, perms)
+			}
+		})
+	}
+}
+
+func TestIsActiveNamespace(t *testing.T) {
+	now := metav1.Now()
+
+	tests := []struct {
+		name   string
+		ns     *corev1.Namespace
+		active bool
+	}{
+		{name: "active", ns: &corev1.Namespace{Status: corev1.NamespaceStatus{Phase: corev1.NamespaceActive}}, active: true},
+		{name: "terminating phase", ns: &corev1.Namespace{Status: corev1.NamespaceStatus{Phase: corev1.NamespaceTerminating}}, active: false},
+		{name: "deleted", ns: &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{DeletionTimestamp: &now}}, active: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if active := IsActiveNamespace(tt.ns); active != tt.active {
+				t.Fatalf("expected active to be %t, got %t", tt.active, active)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package rbac
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	rbac "k8s.io/api/rbac/v1"
+)
+
+// Identity is the user and groups that the API server
+// authorizes requests as and that RBAC is evaluated for
+type Identity struct {
+	// The username of the identity
+	User string
+	// The groups that the identity belongs to
+	Groups []string
+	// The extra information the authenticator provided about the identity.
+	// It is not used by RBAC, but is kept when requests are made as the identity.
+	Extra map[string][]string
+}
+
+// ServiceAccountIdentity returns the Identity that the API server
+// assigns to a ServiceAccount with the given namespace and name
+func ServiceAccountIdentity(namespace string, name string) Identity {
+	return Identity{
+		User: serviceAccountUsername(namespace, name),
+		Groups: []string{
+			"system:serviceaccounts",
+			"system:serviceaccounts:" + namespace,
+			"system:authenticated",
+		},
+	}
+}
+
+// serviceAccountUsername is a helper function to get the username
+// of a ServiceAccount with the given namespace and name
+func serviceAccountUsername(namespace string, name string) string {
+	return fmt.Sprintf("system:serviceaccount:%s:%s", namespace, name)
+}
+
+// Key returns a string that identifies the Identity to RBAC. Identities with the same
+// user and groups have the same key. The extra information is left out because it is not
+// used by RBAC and bound ServiceAccount tokens carry extra information that is unique to
+// each token, such as the name of the pod and the ID of the credential.
+func (i Identity) Key() string {
+	groups := append([]string{}, i.Groups...)
+	sort.Strings(groups)
+
+	return strings.Join([]string{i.User, strings.Join(groups, "\x00")}, "\x01")
+}
+
+// ImpersonationKey returns a string that uniquely identifies everything that requests
+// are made as when impersonating the Identity. Identities with the same user, groups
+// and extra information have the same impersonation key.
+func (i Identity) ImpersonationKey() string {
+	extraKeys := []string{}
+	for key := range i.Extra {
+		extraKeys = append(extraKeys, key)
+	}
+	sort.Strings(extraKeys)
+
+	parts := []string{i.Key()}
+	for _, key := range extraKeys {
+		values := append([]string{}, i.Extra[key]...)
+		sort.Strings(values)
+		parts = append(parts, key+"="+strings.Join(values, "\x00"))
+	}
+
+	return strings.Join(parts, "\x01")
+}
+
+// Matches returns whether or not the Identity is the given subject of a binding in the
+// given namespace. The namespace should be empty for a ClusterRoleBinding. Subjects
+// are matched the same way the API server's RBAC authorizer matches them.
+func (i Identity) Matches(sub rbac.Subject, bindingNamespace string) bool {
+	switch sub.Kind {
+	case rbac.ServiceAccountKind:
+		// A ServiceAccount subject without a namespace is in the namespace of the binding
+		namespace := bindingNamespace
+		if sub.Namespace != "" {
+			namespace = sub.Namespace
+		}
+		return namespace != "" && serviceAccountUsername(namespace, sub.Name) == i.User
+	case rbac.UserKind:
+		return sub.Name == i.User
+	case rbac.GroupKind:
+		for _, group := range i.Groups {
+			if sub.Name == group {
+				return true
+			}
+		}
+	}
+
+	return false
+}
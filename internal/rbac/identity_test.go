@@ -0,0 +1,63 @@
+package rbac
+
+import (
+	"testing"
+
+	rbac "k8s.io/api/rbac/v1"
+)
+
+func TestIdentityKey(t *testing.T) {
+	first := Identity{
+		User:   "system:serviceaccount:default:operator",
+		Groups: []string{"system:serviceaccounts", "system:authenticated"},
+		Extra:  map[string][]string{"authentication.kubernetes.io/pod-name": {"operator-abc"}},
+	}
+	second := Identity{
+		User:   "system:serviceaccount:default:operator",
+		Groups: []string{"system:authenticated", "system:serviceaccounts"},
+		Extra:  map[string][]string{"authentication.kubernetes.io/pod-name": {"operator-def"}},
+	}
+
+	if first.Key() != second.Key() {
+		t.Fatalf("expected identities with the same user and groups to have the same key")
+	}
+	if first.ImpersonationKey() == second.ImpersonationKey() {
+		t.Fatalf("expected identities with different extra information to have different impersonation keys")
+	}
+
+	other := Identity{User: first.User, Groups: []string{"system:authenticated"}}
+	if first.Key() == other.Key() {
+		t.Fatalf("expected identities with different groups to have different keys")
+	}
+}
+
+func TestIdentityMatches(t *testing.T) {
+	identity := ServiceAccountIdentity("default", "operator")
+
+	tests := []struct {
+		name             string
+		subject          rbac.Subject
+		bindingNamespace string
+		matches          bool
+	}{
+		{name: "ServiceAccount", subject: rbac.Subject{Kind: rbac.ServiceAccountKind, Name: "operator", Namespace: "default"}, matches: true},
+		{name: "ServiceAccount in the binding namespace", subject: rbac.Subject{Kind: rbac.ServiceAccountKind, Name: "operator"}, bindingNamespace: "default", matches: true},
+		{name: "ServiceAccount in another namespace than the binding", subject: rbac.Subject{Kind: rbac.ServiceAccountKind, Name: "operator", Namespace: "default"}, bindingNamespace: "other", matches: true},
+		{name: "ServiceAccount without a namespace", subject: rbac.Subject{Kind: rbac.ServiceAccountKind, Name: "operator"}, matches: false},
+		{name: "other ServiceAccount", subject: rbac.Subject{Kind: rbac.ServiceAccountKind, Name: "other", Namespace: "default"}, matches: false},
+		{name: "ServiceAccount in another namespace", subject: rbac.Subject{Kind: rbac.ServiceAccountKind, Name: "operator", Namespace: "other"}, matches: false},
+		{name: "User", subject: rbac.Subject{Kind: rbac.UserKind, Name: "system:serviceaccount:default:operator"}, matches: true},
+		{name: "other User", subject: rbac.Subject{Kind: rbac.UserKind, Name: "operator"}, matches: false},
+		{name: "Group", subject: rbac.Subject{Kind: rbac.GroupKind, Name: "system:serviceaccounts:default"}, matches: true},
+		{name: "other Group", subject: rbac.Subject{Kind: rbac.GroupKind, Name: "system:masters"}, matches: false},
+		{name: "unknown kind", subject: rbac.Subject{Kind: "Unknown", Name: "system:serviceaccount:default:operator"}, matches: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if matches := identity.Matches(tt.subject, tt.bindingNamespace); matches != tt.matches {
+				t.Fatalf("expected matches to be %t, got %t", tt.matches, matches)
+			}
+		})
+	}
+}
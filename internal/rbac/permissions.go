@@ -0,0 +1,188 @@
+package rbac
+
+import (
+	"sort"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	rbac "k8s.io/api/rbac/v1"
+)
+
+// Permissions is a mapping of group/resource keys to a map of verbs and the
+// ResourceNames each verb is restricted to. Resources in the core API group
+// have an empty group and either part of the key can be the `*` wildcard.
+// For example map["/pods"] --> map{"get":nil, "list":nil, "watch":nil}
+// or map["apps/deployments"] --> map{"get":ResourceNames{"my-deployment":{}}}
+type Permissions map[string]map[string]ResourceNames
+
+// ResourceNames is a set of resource names that a verb is restricted to.
+// A nil ResourceNames means that the verb is not restricted to any names.
+type ResourceNames map[string]struct{}
+
+// NamespacedPermissions is a mapping of namespaces to Permissions
+// For example map["default"] --> Permissions
+type NamespacedPermissions map[string]Permissions
+
+// PermissionsSnapshot is an immutable view of the permissions
+// that the ServiceAccount has at a point in time
+type PermissionsSnapshot struct {
+	// The cluster level permissions the ServiceAccount has
+	ClusterPermissions Permissions
+	// The namespace level permissions the ServiceAccount has
+	NamespacePermissions NamespacedPermissions
+	// The namespaces of the cluster that are not terminating, nil when the namespaces are not known
+	Namespaces map[string]struct{}
+	// The errors of the namespaces whose permissions could not be discovered keyed by namespace.
+	// They are left out of the namespace level permissions.
+	FailedNamespaces map[string]error
+}
+
+// HasNamespace returns whether or not the namespace exists and is not terminating.
+// Every namespace is assumed to exist when the namespaces are not known.
+func (s *PermissionsSnapshot) HasNamespace(namespace string) bool {
+	if s.Namespaces == nil {
+		return true
+	}
+
+	_, ok := s.Namespaces[namespace]
+	return ok
+}
+
+// NamespaceAllows returns whether or not the verb is permitted for the given group and resource
+// in the namespace by either the cluster level or the namespace level permissions. A namespace
+// that does not exist or is terminating does not permit anything.
+func (s *PermissionsSnapshot) NamespaceAllows(namespace string, group string, resource string, verb string) bool {
+	if !s.HasNamespace(namespace) {
+		return false
+	}
+
+	return s.ClusterPermissions.Allows(group, resource, verb) || s.NamespacePermissions[namespace].Allows(group, resource, verb)
+}
+
+// PermittedNamespaces returns the sorted namespaces that permit the verb for the given group and
+// resource. When the namespaces are known this is every namespace that is not terminating if the
+// cluster level permissions include the verb, and otherwise the namespaces that are not terminating
+// and whose namespace level permissions include it. When the namespaces are not known only namespaces
+// with namespace level permissions can be returned.
+func (s *PermissionsSnapshot) PermittedNamespaces(group string, resource string, verb string) []string {
+	candidates := s.Namespaces
+	if candidates == nil {
+		candidates = map[string]struct{}{}
+		for namespace := range s.NamespacePermissions {
+			candidates[namespace] = struct{}{}
+		}
+	}
+
+	namespaces := []string{}
+	for namespace := range candidates {
+		if s.NamespaceAllows(namespace, group, resource, verb) {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// PermissionsKey returns the key of the Permissions for the given group and resource
+func PermissionsKey(group string, resource string) string {
+	return group + "/" + resource
+}
+
+// Allows returns whether or not the Permissions include the verb for the given
+// group and resource without being restricted to specific resource names.
+// Wildcards for the group, resource and verb are honored.
+func (p Permissions) Allows(group string, resource string, verb string) bool {
+	for _, g := range []string{group, "*"} {
+		for _, r := range []string{resource, "*"} {
+			verbs, ok := p[PermissionsKey(g, r)]
+			if !ok {
+				continue
+			}
+			for _, v := range []string{verb, "*"} {
+				if names, ok := verbs[v]; ok && names == nil {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// ResourceNames returns the sorted names of the resources that the Permissions include
+// the verb for when the verb is restricted to specific resource names for the given
+// group and resource. Wildcards for the group, resource and verb are honored.
+func (p Permissions) ResourceNames(group string, resource string, verb string) []string {
+	set := ResourceNames{}
+	for _, g := range []string{group, "*"} {
+		for _, r := range []string{resource, "*"} {
+			verbs, ok := p[PermissionsKey(g, r)]
+			if !ok {
+				continue
+			}
+			for _, v := range []string{verb, "*"} {
+				for name := range verbs[v] {
+					set[name] = struct{}{}
+				}
+			}
+		}
+	}
+
+	names := []string{}
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mergeResourceNames is a helper function that returns the union of two
+// ResourceNames. If either of them is not restricted the union is not restricted.
+func mergeResourceNames(a ResourceNames, b ResourceNames) ResourceNames {
+	if a == nil || b == nil {
+		return nil
+	}
+
+	merged := ResourceNames{}
+	for name := range a {
+		merged[name] = struct{}{}
+	}
+	for name := range b {
+		merged[name] = struct{}{}
+	}
+	return merged
+}
+
+// mergePermissions is a helper function that adds all of the Permissions
+// in from to the Permissions in into. The ResourceNames of a verb that is
+// in both are merged into their union.
+func mergePermissions(into Permissions, from Permissions) {
+	for key, verbs := range from {
+		if _, ok := into[key]; !ok {
+			into[key] = map[string]ResourceNames{}
+		}
+		for verb, names := range verbs {
+			if existing, ok := into[key][verb]; ok {
+				into[key][verb] = mergeResourceNames(existing, names)
+			} else { // copied so that into never shares ResourceNames with from
+				into[key][verb] = mergeResourceNames(names, ResourceNames{})
+			}
+		}
+	}
+}
+
+// PermissionsForResourceRules returns the Permissions that the resource rules
+// of a SelfSubjectRulesReview for the given namespace grant
+func PermissionsForResourceRules(namespace string, rules []authorizationv1.ResourceRule) Permissions {
+	policyRules := []rbac.PolicyRule{}
+	for _, rule := range rules {
+		policyRules = append(policyRules, rbac.PolicyRule{
+			Verbs:         rule.Verbs,
+			APIGroups:     rule.APIGroups,
+			Resources:     rule.Resources,
+			ResourceNames: rule.ResourceNames,
+		})
+	}
+
+	return getPermissionsForRules("SelfSubjectRulesReview", namespace, policyRules)
+}
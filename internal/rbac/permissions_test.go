@@ -0,0 +1,144 @@
+package rbac
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeResourceNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		a        ResourceNames
+		b        ResourceNames
+		expected ResourceNames
+	}{
+		{name: "both restricted", a: ResourceNames{"a": {}}, b: ResourceNames{"b": {}}, expected: ResourceNames{"a": {}, "b": {}}},
+		{name: "first unrestricted", a: nil, b: ResourceNames{"b": {}}, expected: nil},
+		{name: "second unrestricted", a: ResourceNames{"a": {}}, b: nil, expected: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if merged := mergeResourceNames(tt.a, tt.b); !reflect.DeepEqual(merged, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, merged)
+			}
+		})
+	}
+}
+
+func TestMergePermissions(t *testing.T) {
+	from := Permissions{
+		PermissionsKey("", "pods"):  {"get": ResourceNames{"b": {}}, "list": nil},
+		PermissionsKey("", "nodes"): {"get": ResourceNames{"node-1": {}}},
+	}
+	into := Permissions{
+		PermissionsKey("", "pods"): {"get": ResourceNames{"a": {}}, "watch": nil},
+	}
+
+	mergePermissions(into, from)
+
+	expected := Permissions{
+		PermissionsKey("", "pods"):  {"get": ResourceNames{"a": {}, "b": {}}, "list": nil, "watch": nil},
+		PermissionsKey("", "nodes"): {"get": ResourceNames{"node-1": {}}},
+	}
+	if !reflect.DeepEqual(into, expected) {
+		t.Fatalf("expected %v, got %v", expected, into)
+	}
+
+	// the merged Permissions must not share ResourceNames with the Permissions they were merged from
+	into[PermissionsKey("", "nodes")]["get"]["node-2"] = struct{}{}
+	if _, ok := from[PermissionsKey("", "nodes")]["get"]["node-2"]; ok {
+		t.Fatalf("expected the merged ResourceNames to be a copy")
+	}
+}
+
+func TestPermissionsAllows(t *testing.T) {
+	tests := []struct {
+		name   string
+		perms  Permissions
+		allows bool
+	}{
+		{name: "exact", perms: Permissions{PermissionsKey("apps", "deployments"): {"list": nil}}, allows: true},
+		{name: "wildcard group", perms: Permissions{PermissionsKey("*", "deployments"): {"list": nil}}, allows: true},
+		{name: "wildcard resource", perms: Permissions{PermissionsKey("apps", "*"): {"list": nil}}, allows: true},
+		{name: "wildcard verb", perms: Permissions{PermissionsKey("apps", "deployments"): {"*": nil}}, allows: true},
+		{name: "other verb", perms: Permissions{PermissionsKey("apps", "deployments"): {"get": nil}}, allows: false},
+		{name: "other group", perms: Permissions{PermissionsKey("", "deployments"): {"list": nil}}, allows: false},
+		{name: "restricted to names", perms: Permissions{PermissionsKey("apps", "deployments"): {"list": ResourceNames{"a": {}}}}, allows: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if allows := tt.perms.Allows("apps", "deployments", "list"); allows != tt.allows {
+				t.Fatalf("expected allows to be %t, got %t", tt.allows, allows)
+			}
+		})
+	}
+}
+
+func TestPermissionsResourceNames(t *testing.T) {
+	perms := Permissions{
+		PermissionsKey("apps", "deployments"): {"get": ResourceNames{"b": {}}, "list": nil},
+		PermissionsKey("*", "deployments"):    {"*": ResourceNames{"a": {}}},
+		PermissionsKey("apps", "*"):           {"get": ResourceNames{"b": {}, "c": {}}},
+		PermissionsKey("", "pods"):            {"get": ResourceNames{"d": {}}},
+	}
+
+	expected := []string{"a", "b", "c"}
+	if names := perms.ResourceNames("apps", "deployments", "get"); !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected names %v, got %v", expected, names)
+	}
+	if names := perms.ResourceNames("apps", "deployments", "list"); !reflect.DeepEqual(names, []string{"a"}) {
+		t.Fatalf("expected names [a], got %v", names)
+	}
+}
+
+func TestPermissionsSnapshotPermittedNamespaces(t *testing.T) {
+	listPods := Permissions{PermissionsKey("", "pods"): {"list": nil}}
+
+	tests := []struct {
+		name       string
+		snapshot   *PermissionsSnapshot
+		namespaces []string
+	}{
+		{
+			name: "namespace permissions without known namespaces",
+			snapshot: &PermissionsSnapshot{
+				NamespacePermissions: NamespacedPermissions{"b": listPods, "a": listPods, "c": Permissions{}},
+			},
+			namespaces: []string{"a", "b"},
+		},
+		{
+			name: "cluster permissions without known namespaces",
+			snapshot: &PermissionsSnapshot{
+				ClusterPermissions:   listPods,
+				NamespacePermissions: NamespacedPermissions{"a": Permissions{}},
+			},
+			namespaces: []string{"a"},
+		},
+		{
+			name: "namespace permissions leave out unknown namespaces",
+			snapshot: &PermissionsSnapshot{
+				NamespacePermissions: NamespacedPermissions{"a": listPods, "terminating": listPods},
+				Namespaces:           map[string]struct{}{"a": {}, "b": {}},
+			},
+			namespaces: []string{"a"},
+		},
+		{
+			name: "cluster permissions include every known namespace",
+			snapshot: &PermissionsSnapshot{
+				ClusterPermissions: listPods,
+				Namespaces:         map[string]struct{}{"b": {}, "a": {}},
+			},
+			namespaces: []string{"a", "b"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if namespaces := tt.snapshot.PermittedNamespaces("", "pods", "list"); !reflect.DeepEqual(namespaces, tt.namespaces) {
+				t.Fatalf("expected namespaces %v, got %v", tt.namespaces, namespaces)
+			}
+		})
+	}
+}
@@ -3,7 +3,11 @@ package rbac
 import (
 	"context"
 	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
 
+	corev1 "k8s.io/api/core/v1"
 	rbac "k8s.io/api/rbac/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/rest"
@@ -13,8 +17,8 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-// TODO: Open Question: Do we need to watch the ClusterRoles and Roles that are applied to the SA via a binding with informers in the case that the roles are modified?
-// - For now keep the scope to the bindings and then see about adding the more granular functionality
+// rbacKinds are the kinds of the RBAC resources that permissions are computed from
+var rbacKinds = []string{"ClusterRoleBinding", "RoleBinding", "ClusterRole", "Role"}
 
 // RBACWatcher is a struct meant for watching RBAC changes
 // and updating a cache of RBAC permissions that can be used
@@ -22,157 +26,324 @@ import (
 type RBACWatcher struct {
 	// The name of the ServiceAccount to watch RBAC for
 	ServiceAccountName string
-	// The cluster level permissions the ServiceAccount has
-	ClusterPermissions Permissions
-	// The namespace level permissions the ServiceAccount has
-	NamespacePermissions NamespacedPermissions
+	// The namespace of the ServiceAccount to watch RBAC for
+	ServiceAccountNamespace string
+	// The Identity that the API server assigns to the ServiceAccount
+	Identity Identity
+	// The latest published snapshot of the permissions the ServiceAccount has
+	snapshot *PermissionsSnapshot
+	// The mutex that guards the snapshot
+	snapshotMu sync.RWMutex
 	// The controller-runtime cache used to create and manage informers
 	cache crcache.Cache
-	// A controller-runtime client for the RBACWatcher to make any API requests it may need to make
-	cli client.Client
+	// The Permissions contributed by each ClusterRoleBinding keyed by name
+	clusterContributions map[string]Permissions
+	// The Permissions contributed by each RoleBinding keyed by namespace and then name
+	namespaceContributions map[string]map[string]Permissions
+	// The mutex that guards the contributions
+	contributionsMu sync.Mutex
+	// The channels of the subscribers that are notified when the permissions change
+	subscribers map[int]chan struct{}
+	// The id to use for the next subscriber
+	nextSubscriber int
+	// The mutex that guards the subscribers
+	subscribersMu sync.Mutex
+	// Whether or not the permissions have been computed from synced informers, accessed atomically
+	synced int32
+	// Whether or not the Namespaces of the cluster are watched
+	watchNamespaces bool
+	// The namespaces of the cluster that are not terminating, guarded by the contributions mutex
+	namespaces map[string]struct{}
 }
 
-// Permissions is a mapping of resources to a map of permissions
-// For example map["pods"] --> map{"get":0, "list":0, "watch":0}
-type Permissions map[string]map[string]interface{}
-
-// NamespacedPermissions is a mapping of namespaces to Permissions
-// For example map["default"] --> Permissions
-type NamespacedPermissions map[string]Permissions
+// NewRBACWatcher creates a new RBACWatcher for the ServiceAccount with the given namespace and name
+func NewRBACWatcher(namespace string, sa string) *RBACWatcher {
+	w := newRBACWatcher(ServiceAccountIdentity(namespace, sa))
+	w.ServiceAccountName = sa
+	w.ServiceAccountNamespace = namespace
+	return w
+}
 
-// NewRBACWatcher creates a new RBACWatcher for the given ServiceAccount name
-func NewRBACWatcher(sa string) *RBACWatcher {
+// newRBACWatcher is a helper function to create a new RBACWatcher for the given Identity
+func newRBACWatcher(identity Identity) *RBACWatcher {
 	return &RBACWatcher{
-		ServiceAccountName:   sa,
-		ClusterPermissions:   Permissions{},
-		NamespacePermissions: NamespacedPermissions{},
+		Identity:               identity,
+		snapshot:               &PermissionsSnapshot{ClusterPermissions: Permissions{}, NamespacePermissions: NamespacedPermissions{}},
+		clusterContributions:   map[string]Permissions{},
+		namespaceContributions: map[string]map[string]Permissions{},
+		subscribers:            map[int]chan struct{}{},
+		namespaces:             map[string]struct{}{},
 	}
 }
 
 // Initialize creates and configures the controller-runtime cache and informers
-// that are used under the hood to keep the ClusterPermissions and NamespacePermissions
-// up to date.
+// that are used under the hood to keep the published PermissionsSnapshot up to date.
 func (w *RBACWatcher) Initialize(ctx context.Context, cfg *rest.Config) error {
 	var err error
-	opts := crcache.Options{}
-	w.cli, err = client.New(cfg, client.Options{})
+	w.cache, w.watchNamespaces, err = newRBACCache(ctx, cfg)
 	if err != nil {
-		return fmt.Errorf("encountered an error creating client: %w", err)
+		return err
 	}
-	w.cache, err = crcache.New(cfg, opts)
+
+	return addEventHandlers(ctx, w.cache, w.watchNamespaces, w.eventHandler)
+}
+
+// newRBACCache is a helper function to create a controller-runtime cache
+// with informers for the ClusterRoleBindings, RoleBindings, ClusterRoles
+// and Roles of the cluster, and for the Namespaces of the cluster when
+// they can be listed and watched. It returns the cache, a bool that is true
+// if the Namespaces are watched, and an error if the cache can't be created.
+func newRBACCache(ctx context.Context, cfg *rest.Config) (crcache.Cache, bool, error) {
+	c, err := crcache.New(cfg, crcache.Options{})
 	if err != nil {
-		return fmt.Errorf("encountered an error creating cache: %w", err)
+		return nil, false, fmt.Errorf("encountered an error creating cache: %w", err)
 	}
 
-	crbInformer, err := w.cache.GetInformerForKind(ctx, schema.GroupVersionKind{Group: "rbac.authorization.k8s.io", Version: "v1", Kind: "ClusterRoleBinding"})
-	if err != nil {
-		return fmt.Errorf("encountered an error getting informer for ClusterRoleBinding: %w", err)
+	for _, kind := range rbacKinds {
+		if _, err := c.GetInformerForKind(ctx, rbac.SchemeGroupVersion.WithKind(kind)); err != nil {
+			return nil, false, fmt.Errorf("encountered an error getting informer for %s: %w", kind, err)
+		}
 	}
 
-	rbInformer, err := w.cache.GetInformerForKind(ctx, schema.GroupVersionKind{Group: "rbac.authorization.k8s.io", Version: "v1", Kind: "RoleBinding"})
-	if err != nil {
-		return fmt.Errorf("encountered an error getting informer for RoleBinding: %w", err)
+	// An informer that can't list and watch would never sync, so the
+	// Namespaces are only watched when that is permitted
+	if !canWatchNamespaces(ctx, cfg) {
+		klog.V(0).Infof("Namespaces can not be listed and watched, namespaces are discovered from RoleBindings only")
+		return c, false, nil
+	}
+	if _, err := c.GetInformer(ctx, &corev1.Namespace{}); err != nil {
+		return nil, false, fmt.Errorf("encountered an error getting informer for Namespace: %w", err)
 	}
 
-	crbInformer.AddEventHandler(w.clusterRoleBindingHandler())
-	rbInformer.AddEventHandler(w.roleBindingHandler())
+	return c, true, nil
+}
+
+// addEventHandlers is a helper function to add the cache.ResourceEventHandler that the given function
+// returns for the kind of each informer of the controller-runtime cache to the informer. The Namespace
+// informer only gets an event handler when the Namespaces of the cluster are watched.
+func addEventHandlers(ctx context.Context, c crcache.Cache, watchNamespaces bool, handlerFor func(kind string) cache.ResourceEventHandler) error {
+	gvks := []schema.GroupVersionKind{}
+	for _, kind := range rbacKinds {
+		gvks = append(gvks, rbac.SchemeGroupVersion.WithKind(kind))
+	}
+	if watchNamespaces {
+		gvks = append(gvks, corev1.SchemeGroupVersion.WithKind("Namespace"))
+	}
+
+	for _, gvk := range gvks {
+		informer, err := c.GetInformerForKind(ctx, gvk)
+		if err != nil {
+			return fmt.Errorf("encountered an error getting informer for %s: %w", gvk.Kind, err)
+		}
+		informer.AddEventHandler(handlerFor(gvk.Kind))
+	}
 	return nil
 }
 
+// eventHandler is a helper function to get the cache.ResourceEventHandler
+// of the RBACWatcher for the informer of the given kind
+func (w *RBACWatcher) eventHandler(kind string) cache.ResourceEventHandler {
+	switch kind {
+	case "ClusterRoleBinding":
+		return w.clusterRoleBindingHandler()
+	case "RoleBinding":
+		return w.roleBindingHandler()
+	case "ClusterRole":
+		return w.clusterRoleHandler()
+	case "Role":
+		return w.roleHandler()
+	case "Namespace":
+		return w.namespaceHandler()
+	}
+
+	return cache.ResourceEventHandlerFuncs{}
+}
+
 // Start starts the RBACWatcher. This function is blocking.
 func (w *RBACWatcher) Start(ctx context.Context) error {
 	return w.cache.Start(ctx)
 }
 
+// WaitForSync blocks until the informers of the RBACWatcher have synced and the
+// permissions have been computed from every binding in the synced informers.
+// It returns false if the context is closed before the informers have synced.
+func (w *RBACWatcher) WaitForSync(ctx context.Context) bool {
+	if !w.cache.WaitForCacheSync(ctx) {
+		return false
+	}
+
+	// The event handlers may still be processing the initial events,
+	// so compute the permissions from everything in the synced informers
+	if w.watchNamespaces {
+		nsList := &corev1.NamespaceList{}
+		if err := w.cache.List(ctx, nsList); err != nil {
+			klog.V(0).Infof("encountered an error listing Namespaces: %v", err)
+			return false
+		}
+		w.syncNamespaces(nsList.Items)
+	}
+	crbList := &rbac.ClusterRoleBindingList{}
+	if err := w.cache.List(ctx, crbList); err != nil {
+		klog.V(0).Infof("encountered an error listing ClusterRoleBindings: %v", err)
+		return false
+	}
+	rbList := &rbac.RoleBindingList{}
+	if err := w.cache.List(ctx, rbList); err != nil {
+		klog.V(0).Infof("encountered an error listing RoleBindings: %v", err)
+		return false
+	}
+	w.syncBindings(crbList.Items, rbList.Items)
+
+	atomic.StoreInt32(&w.synced, 1)
+	return true
+}
+
+// HasSynced returns whether or not the permissions of the RBACWatcher have synced
+func (w *RBACWatcher) HasSynced() bool {
+	return atomic.LoadInt32(&w.synced) == 1
+}
+
+// Snapshot returns the latest published PermissionsSnapshot. The returned
+// PermissionsSnapshot is never modified, so a request can be evaluated
+// against it without being affected by concurrent RBAC changes.
+func (w *RBACWatcher) Snapshot() *PermissionsSnapshot {
+	w.snapshotMu.RLock()
+	defer w.snapshotMu.RUnlock()
+	return w.snapshot
+}
+
+// Subscribe registers a new subscriber that is notified whenever the permissions
+// of the RBACWatcher change. It returns a channel that receives a value after each
+// change and a function that must be called to cancel the subscription. Multiple
+// changes that happen before the subscriber reads from the channel are coalesced
+// into a single notification.
+func (w *RBACWatcher) Subscribe() (<-chan struct{}, func()) {
+	w.subscribersMu.Lock()
+	defer w.subscribersMu.Unlock()
+
+	id := w.nextSubscriber
+	w.nextSubscriber++
+	ch := make(chan struct{}, 1)
+	w.subscribers[id] = ch
+
+	return ch, func() {
+		w.subscribersMu.Lock()
+		defer w.subscribersMu.Unlock()
+		delete(w.subscribers, id)
+	}
+}
+
+// hasSubscribers is a helper function to determine if the RBACWatcher has any subscribers
+func (w *RBACWatcher) hasSubscribers() bool {
+	w.subscribersMu.Lock()
+	defer w.subscribersMu.Unlock()
+	return len(w.subscribers) > 0
+}
+
+// notify is a helper function to notify all subscribers that the permissions changed
+func (w *RBACWatcher) notify() {
+	w.subscribersMu.Lock()
+	defer w.subscribersMu.Unlock()
+
+	for _, ch := range w.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default: // a notification is already pending for this subscriber
+		}
+	}
+}
+
+// deletedObject is a helper function to get the deleted object of a delete event. When the
+// informer missed the delete the object is wrapped in a cache.DeletedFinalStateUnknown.
+func deletedObject(obj interface{}) interface{} {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		return tombstone.Obj
+	}
+
+	return obj
+}
+
 // clusterRoleBindingHandler is a helper function for creating the ResourceEventHandlerFuncs
 // that is used by the ClusterRoleBinding informer
 func (w *RBACWatcher) clusterRoleBindingHandler() cache.ResourceEventHandlerFuncs {
 	return cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			crb := obj.(*rbac.ClusterRoleBinding)
-			for _, sub := range crb.Subjects {
-				if sub.Kind == "ServiceAccount" && sub.Name == w.ServiceAccountName {
-					perms := getPermissionsForClusterRoleBinding(w.cli, crb)
-					w.addClusterPerms(perms)
-					klog.V(0).Infof("Cluster Permissions after add -- ", w.ClusterPermissions)
-					break
-				}
-			}
+			w.syncBindings([]rbac.ClusterRoleBinding{*crb}, nil)
 		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
-			oldCrb := oldObj.(*rbac.ClusterRoleBinding)
-			var oldPerms Permissions
 			newCrb := newObj.(*rbac.ClusterRoleBinding)
-			var newPerms Permissions
-			hadSA := false
-			hasSA := false
-
-			for _, sub := range oldCrb.Subjects {
-				if sub.Kind == "ServiceAccount" && sub.Name == w.ServiceAccountName {
-					oldPerms = getPermissionsForClusterRoleBinding(w.cli, oldCrb)
-					hadSA = true
-					break
-				}
-			}
-
-			for _, sub := range newCrb.Subjects {
-				if sub.Kind == "ServiceAccount" && sub.Name == w.ServiceAccountName {
-					newPerms = getPermissionsForClusterRoleBinding(w.cli, oldCrb)
-					hasSA = true
-					break
-				}
-			}
-
-			// Only change that can be made is that the ServiceAccount could be removed from the subjects of a binding
-			if hadSA && !hasSA { // SA was removed
-				w.deleteClusterPerms(oldPerms)
-				klog.V(0).Infof("Cluster Permissions after update -- ", w.ClusterPermissions)
-			} else if !hadSA && hasSA { // SA was added
-				w.addClusterPerms(newPerms)
-				klog.V(0).Infof("Cluster Permissions after update -- ", w.ClusterPermissions)
+			w.syncBindings([]rbac.ClusterRoleBinding{*newCrb}, nil)
+		},
+		DeleteFunc: func(obj interface{}) {
+			crb, ok := deletedObject(obj).(*rbac.ClusterRoleBinding)
+			if !ok {
+				klog.V(0).Infof("received an unexpected object of type %T for a deleted ClusterRoleBinding", obj)
+				return
 			}
+			w.contributionsMu.Lock()
+			defer w.contributionsMu.Unlock()
+			delete(w.clusterContributions, crb.Name)
+			w.rebuildPermissions()
+		},
+	}
+}
 
+// namespaceHandler is a helper function for creating the ResourceEventHandlerFuncs
+// that is used by the Namespace informer
+func (w *RBACWatcher) namespaceHandler() cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			ns := obj.(*corev1.Namespace)
+			w.setNamespace(ns.Name, IsActiveNamespace(ns))
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			newNs := newObj.(*corev1.Namespace)
+			w.setNamespace(newNs.Name, IsActiveNamespace(newNs))
 		},
 		DeleteFunc: func(obj interface{}) {
-			crb := obj.(*rbac.ClusterRoleBinding)
-			for _, sub := range crb.Subjects {
-				if sub.Kind == "ServiceAccount" && sub.Name == w.ServiceAccountName {
-					perms := getPermissionsForClusterRoleBinding(w.cli, crb)
-					w.deleteClusterPerms(perms)
-					klog.V(0).Infof("Cluster Permissions after delete -- ", w.ClusterPermissions)
-					break
-				}
+			ns, ok := deletedObject(obj).(*corev1.Namespace)
+			if !ok {
+				klog.V(0).Infof("received an unexpected object of type %T for a deleted Namespace", obj)
+				return
 			}
+			w.setNamespace(ns.Name, false)
 		},
 	}
 }
 
-// addClusterPerms is a helper function to add permissions
-// to the ClusterPermissions field.
-func (w *RBACWatcher) addClusterPerms(perms Permissions) {
-	for key, value := range perms {
-		if _, ok := w.ClusterPermissions[key]; ok {
-			for k, v := range value {
-				if _, ok := w.ClusterPermissions[key][k]; !ok {
-					w.ClusterPermissions[key][k] = v
-				}
-			}
-		} else {
-			w.ClusterPermissions[key] = value
-		}
+// setNamespace is a helper function to add a namespace to or remove it from the
+// namespaces that are not terminating. The permissions are only rebuilt when the
+// namespaces changed, so status updates of a Namespace don't notify subscribers.
+func (w *RBACWatcher) setNamespace(namespace string, active bool) {
+	w.contributionsMu.Lock()
+	defer w.contributionsMu.Unlock()
+
+	if _, ok := w.namespaces[namespace]; ok == active {
+		return
 	}
+
+	if active {
+		w.namespaces[namespace] = struct{}{}
+	} else {
+		delete(w.namespaces, namespace)
+	}
+	w.rebuildPermissions()
 }
 
-// deleteClusterPerms is a helper function to delete permissions
-// from the ClusterPermissions field
-func (w *RBACWatcher) deleteClusterPerms(perms Permissions) {
-	for key, value := range perms {
-		if _, ok := w.ClusterPermissions[key]; ok {
-			for k, _ := range value {
-				delete(w.ClusterPermissions[key], k)
-			}
+// syncNamespaces is a helper function to replace the namespaces that
+// are not terminating with the given Namespaces and rebuild the permissions
+func (w *RBACWatcher) syncNamespaces(namespaces []corev1.Namespace) {
+	w.contributionsMu.Lock()
+	defer w.contributionsMu.Unlock()
+
+	w.namespaces = map[string]struct{}{}
+	for i := range namespaces {
+		if IsActiveNamespace(&namespaces[i]) {
+			w.namespaces[namespaces[i].Name] = struct{}{}
 		}
 	}
+	w.rebuildPermissions()
 }
 
 // roleBindingHandler is a helper function for creating the ResourceEventHandlerFuncs
@@ -181,93 +352,252 @@ func (w *RBACWatcher) roleBindingHandler() cache.ResourceEventHandlerFuncs {
 	return cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			rb := obj.(*rbac.RoleBinding)
-			for _, sub := range rb.Subjects {
-				if sub.Kind == "ServiceAccount" && sub.Name == w.ServiceAccountName {
-					perms := getPermissionsForRoleBinding(w.cli, rb)
-					w.addNamespacedPerms(rb.Namespace, perms)
-					klog.V(0).Infof("Namespace Permissions after add -- ", w.NamespacePermissions)
-					break
-				}
-			}
+			w.syncBindings(nil, []rbac.RoleBinding{*rb})
 		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
-			oldRb := oldObj.(*rbac.RoleBinding)
-			var oldPerms Permissions
 			newRb := newObj.(*rbac.RoleBinding)
-			var newPerms Permissions
-			hadSA := false
-			hasSA := false
-
-			for _, sub := range oldRb.Subjects {
-				if sub.Kind == "ServiceAccount" && sub.Name == w.ServiceAccountName {
-					oldPerms = getPermissionsForRoleBinding(w.cli, oldRb)
-					hadSA = true
-					break
-				}
+			w.syncBindings(nil, []rbac.RoleBinding{*newRb})
+		},
+		DeleteFunc: func(obj interface{}) {
+			rb, ok := deletedObject(obj).(*rbac.RoleBinding)
+			if !ok {
+				klog.V(0).Infof("received an unexpected object of type %T for a deleted RoleBinding", obj)
+				return
+			}
+			w.contributionsMu.Lock()
+			defer w.contributionsMu.Unlock()
+			delete(w.namespaceContributions[rb.Namespace], rb.Name)
+			w.rebuildPermissions()
+		},
+	}
+}
+
+// clusterRoleHandler is a helper function for creating the ResourceEventHandlerFuncs
+// that is used by the ClusterRole informer. Changes to a ClusterRole are also applied
+// to every aggregated ClusterRole that it is aggregated into.
+func (w *RBACWatcher) clusterRoleHandler() cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			cr := obj.(*rbac.ClusterRole)
+			// The ClusterRole may have been created after the bindings that reference it
+			w.syncBindingsForClusterRoles(cr)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldCr := oldObj.(*rbac.ClusterRole)
+			newCr := newObj.(*rbac.ClusterRole)
+
+			// Only a change to the rules, labels or aggregation can change the permissions
+			if reflect.DeepEqual(oldCr.Rules, newCr.Rules) &&
+				reflect.DeepEqual(oldCr.Labels, newCr.Labels) &&
+				reflect.DeepEqual(oldCr.AggregationRule, newCr.AggregationRule) {
+				return
 			}
 
-			for _, sub := range newRb.Subjects {
-				if sub.Kind == "ServiceAccount" && sub.Name == w.ServiceAccountName {
-					newPerms = getPermissionsForRoleBinding(w.cli, oldRb)
-					hasSA = true
-					break
-				}
+			w.syncBindingsForClusterRoles(oldCr, newCr)
+		},
+		DeleteFunc: func(obj interface{}) {
+			cr, ok := deletedObject(obj).(*rbac.ClusterRole)
+			if !ok {
+				klog.V(0).Infof("received an unexpected object of type %T for a deleted ClusterRole", obj)
+				return
 			}
+			w.syncBindingsForClusterRoles(cr)
+		},
+	}
+}
 
-			// Only change that can be made is that the ServiceAccount could be removed from the subjects of a binding
-			if hadSA && !hasSA { // SA was removed
-				w.deleteNamespacedPerms(oldRb.Namespace, oldPerms)
-				klog.V(0).Infof("Namespace Permissions after update -- ", w.NamespacePermissions)
-			} else if !hadSA && hasSA { // SA was added
-				w.addNamespacedPerms(newRb.Namespace, newPerms)
-				klog.V(0).Infof("Namespace Permissions after update -- ", w.NamespacePermissions)
+// roleHandler is a helper function for creating the ResourceEventHandlerFuncs
+// that is used by the Role informer
+func (w *RBACWatcher) roleHandler() cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			role := obj.(*rbac.Role)
+			// The Role may have been created after the bindings that reference it
+			_, rbs := w.bindingsForRole("Role", role.Name, role.Namespace)
+			w.syncBindings(nil, rbs)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldRole := oldObj.(*rbac.Role)
+			newRole := newObj.(*rbac.Role)
+
+			// Only a change to the rules can change the permissions
+			if reflect.DeepEqual(oldRole.Rules, newRole.Rules) {
+				return
 			}
 
+			_, rbs := w.bindingsForRole("Role", newRole.Name, newRole.Namespace)
+			w.syncBindings(nil, rbs)
 		},
 		DeleteFunc: func(obj interface{}) {
-			rb := obj.(*rbac.RoleBinding)
-			for _, sub := range rb.Subjects {
-				if sub.Kind == "ServiceAccount" && sub.Name == w.ServiceAccountName {
-					perms := getPermissionsForRoleBinding(w.cli, rb)
-					w.deleteNamespacedPerms(rb.Namespace, perms)
-					klog.V(0).Infof("Namespace Permissions after delete -- ", w.NamespacePermissions)
-					break
-				}
+			role, ok := deletedObject(obj).(*rbac.Role)
+			if !ok {
+				klog.V(0).Infof("received an unexpected object of type %T for a deleted Role", obj)
+				return
 			}
+			_, rbs := w.bindingsForRole("Role", role.Name, role.Namespace)
+			w.syncBindings(nil, rbs)
 		},
 	}
 }
 
-// addNamespacedPerms is a helper function to add permissions
-// to the NamespacePermissions field.
-func (w *RBACWatcher) addNamespacedPerms(namespace string, perms Permissions) {
-	if _, ok := w.NamespacePermissions[namespace]; ok {
-		for key, value := range perms {
-			if _, ok := w.NamespacePermissions[namespace][key]; ok {
-				for k, v := range value {
-					if _, ok := w.NamespacePermissions[namespace][key][k]; !ok {
-						w.NamespacePermissions[namespace][key][k] = v
-					}
-				}
-			} else {
-				w.NamespacePermissions[namespace][key] = value
+// syncBindingsForClusterRoles is a helper function to recompute the contributions of every
+// binding that references one of the given ClusterRoles or an aggregated ClusterRole that
+// one of them is aggregated into.
+func (w *RBACWatcher) syncBindingsForClusterRoles(crs ...*rbac.ClusterRole) {
+	names := map[string]struct{}{}
+	for _, cr := range crs {
+		names[cr.Name] = struct{}{}
+		for _, agg := range w.aggregatingClusterRoles(cr) {
+			names[agg.Name] = struct{}{}
+		}
+	}
+
+	crbs := []rbac.ClusterRoleBinding{}
+	rbs := []rbac.RoleBinding{}
+	for name := range names {
+		nameCrbs, nameRbs := w.bindingsForRole("ClusterRole", name, "")
+		crbs = append(crbs, nameCrbs...)
+		rbs = append(rbs, nameRbs...)
+	}
+
+	w.syncBindings(crbs, rbs)
+}
+
+// aggregatingClusterRoles is a helper function to get the aggregated ClusterRoles
+// that the given ClusterRole is aggregated into based on its labels
+func (w *RBACWatcher) aggregatingClusterRoles(cr *rbac.ClusterRole) []rbac.ClusterRole {
+	aggregating := []rbac.ClusterRole{}
+	crList := &rbac.ClusterRoleList{}
+	if err := w.cache.List(context.Background(), crList); err != nil {
+		klog.V(0).Infof("encountered an error listing ClusterRoles: %v", err)
+		return aggregating
+	}
+
+	for _, agg := range crList.Items {
+		if agg.Name != cr.Name && matchesAggregationRule(agg.AggregationRule, cr.Labels) {
+			aggregating = append(aggregating, agg)
+		}
+	}
+
+	return aggregating
+}
+
+// syncBindings is a helper function to recompute the Permissions contributed by each of the
+// given bindings and then rebuild the effective permissions. A binding that does not have
+// the ServiceAccount as a subject does not contribute any Permissions.
+func (w *RBACWatcher) syncBindings(crbs []rbac.ClusterRoleBinding, rbs []rbac.RoleBinding) {
+	w.contributionsMu.Lock()
+	defer w.contributionsMu.Unlock()
+
+	for i := range crbs {
+		crb := &crbs[i]
+		if w.hasSubject(crb.Subjects, "") {
+			w.clusterContributions[crb.Name] = getPermissionsForClusterRoleBinding(w.cache, crb)
+		} else {
+			delete(w.clusterContributions, crb.Name)
+		}
+	}
+
+	for i := range rbs {
+		rb := &rbs[i]
+		if w.hasSubject(rb.Subjects, rb.Namespace) {
+			if _, ok := w.namespaceContributions[rb.Namespace]; !ok {
+				w.namespaceContributions[rb.Namespace] = map[string]Permissions{}
 			}
+			w.namespaceContributions[rb.Namespace][rb.Name] = getPermissionsForRoleBinding(w.cache, rb)
+		} else {
+			delete(w.namespaceContributions[rb.Namespace], rb.Name)
+		}
+	}
+
+	w.rebuildPermissions()
+}
+
+// rebuildPermissions is a helper function to derive the ClusterPermissions and
+// NamespacePermissions from scratch as the union of the Permissions contributed
+// by every binding and publish them as a new PermissionsSnapshot. It must be
+// called while holding the contributions mutex.
+func (w *RBACWatcher) rebuildPermissions() {
+	clusterPerms := Permissions{}
+	for _, perms := range w.clusterContributions {
+		mergePermissions(clusterPerms, perms)
+	}
+
+	nsPerms := NamespacedPermissions{}
+	for namespace, contributions := range w.namespaceContributions {
+		if len(contributions) == 0 {
+			delete(w.namespaceContributions, namespace)
+			continue
+		}
+
+		nsPerms[namespace] = Permissions{}
+		for _, perms := range contributions {
+			mergePermissions(nsPerms[namespace], perms)
 		}
-	} else {
-		w.NamespacePermissions[namespace] = perms
 	}
+
+	var namespaces map[string]struct{}
+	if w.watchNamespaces {
+		namespaces = map[string]struct{}{}
+		for namespace := range w.namespaces {
+			namespaces[namespace] = struct{}{}
+		}
+	}
+
+	w.snapshotMu.Lock()
+	w.snapshot = &PermissionsSnapshot{
+		ClusterPermissions:   clusterPerms,
+		NamespacePermissions: nsPerms,
+		Namespaces:           namespaces,
+	}
+	w.snapshotMu.Unlock()
+	klog.V(5).Infof("Cluster Permissions after rebuild -- %v", clusterPerms)
+	klog.V(5).Infof("Namespace Permissions after rebuild -- %v", nsPerms)
+
+	w.notify()
 }
 
-// deleteNamespacedPerms is a helper function to delete permissions
-// from the NamespacePermissions field.
-func (w *RBACWatcher) deleteNamespacedPerms(namespace string, perms Permissions) {
-	if _, ok := w.NamespacePermissions[namespace]; ok {
-		for key, value := range perms {
-			if _, ok := w.NamespacePermissions[namespace][key]; ok {
-				for k, _ := range value {
-					delete(w.NamespacePermissions[namespace][key], k)
-				}
+// bindingsForRole is a helper function to get the ClusterRoleBindings and RoleBindings
+// of the ServiceAccount that reference the Role or ClusterRole with the given name.
+// The namespace should be empty for a ClusterRole.
+func (w *RBACWatcher) bindingsForRole(kind string, name string, namespace string) ([]rbac.ClusterRoleBinding, []rbac.RoleBinding) {
+	crbs := []rbac.ClusterRoleBinding{}
+	rbs := []rbac.RoleBinding{}
+
+	if kind == "ClusterRole" {
+		crbList := &rbac.ClusterRoleBindingList{}
+		if err := w.cache.List(context.Background(), crbList); err != nil {
+			klog.V(0).Infof("encountered an error listing ClusterRoleBindings: %v", err)
+		}
+		for _, crb := range crbList.Items {
+			if crb.RoleRef.Kind == kind && crb.RoleRef.Name == name && w.hasSubject(crb.Subjects, "") {
+				crbs = append(crbs, crb)
 			}
 		}
 	}
+
+	rbList := &rbac.RoleBindingList{}
+	if err := w.cache.List(context.Background(), rbList, client.InNamespace(namespace)); err != nil {
+		klog.V(0).Infof("encountered an error listing RoleBindings: %v", err)
+	}
+	for _, rb := range rbList.Items {
+		if rb.RoleRef.Kind == kind && rb.RoleRef.Name == name && w.hasSubject(rb.Subjects, rb.Namespace) {
+			rbs = append(rbs, rb)
+		}
+	}
+
+	return crbs, rbs
+}
+
+// hasSubject is a helper function to determine if the Identity of the ServiceAccount
+// is one of the given subjects of a binding in the given namespace. The namespace
+// should be empty for a ClusterRoleBinding.
+func (w *RBACWatcher) hasSubject(subjects []rbac.Subject, bindingNamespace string) bool {
+	for _, sub := range subjects {
+		if w.Identity.Matches(sub, bindingNamespace) {
+			return true
+		}
+	}
+
+	return false
 }
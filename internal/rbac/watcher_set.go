@@ -0,0 +1,215 @@
+package rbac
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+	crcache "sigs.k8s.io/controller-runtime/pkg/cache"
+)
+
+// minWatcherSweepInterval is the minimum interval between looking for idle RBACWatchers
+const minWatcherSweepInterval = time.Second
+
+// identityWatcher is the RBACWatcher of an Identity
+type identityWatcher struct {
+	// The RBACWatcher
+	watcher *RBACWatcher
+	// The last time that the RBACWatcher was requested
+	lastUsed time.Time
+}
+
+// RBACWatcherSet keeps an RBACWatcher for each Identity that requests are
+// handled for. Every RBACWatcher of the set shares the same informers, so
+// the RBAC of the cluster is only watched once no matter how many identities
+// the set tracks the permissions of. The set adds a single event handler to
+// each informer that forwards the events to the RBACWatchers in the set, so
+// an RBACWatcher that is removed from the set no longer handles any events.
+type RBACWatcherSet struct {
+	// The controller-runtime cache shared by the RBACWatchers
+	cache crcache.Cache
+	// How long an RBACWatcher is kept after it was last requested
+	idleTimeout time.Duration
+	// The RBACWatchers keyed by the key of their Identity
+	watchers map[string]*identityWatcher
+	// The mutex that guards the RBACWatchers
+	mu sync.Mutex
+	// The mutex that serializes the creation of RBACWatchers
+	createMu sync.Mutex
+	// Whether or not the informers have synced, accessed atomically
+	synced int32
+	// Whether or not the Namespaces of the cluster are watched
+	watchNamespaces bool
+}
+
+// NewRBACWatcherSet creates a new RBACWatcherSet without any RBACWatchers that removes
+// RBACWatchers that have not been requested for the given idle timeout
+func NewRBACWatcherSet(idleTimeout time.Duration) *RBACWatcherSet {
+	return &RBACWatcherSet{
+		idleTimeout: idleTimeout,
+		watchers:    map[string]*identityWatcher{},
+	}
+}
+
+// Initialize creates and configures the controller-runtime cache and informers
+// that are shared by the RBACWatchers of the RBACWatcherSet
+func (s *RBACWatcherSet) Initialize(ctx context.Context, cfg *rest.Config) error {
+	var err error
+	s.cache, s.watchNamespaces, err = newRBACCache(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	return addEventHandlers(ctx, s.cache, s.watchNamespaces, s.dispatchHandler)
+}
+
+// Start starts the informers of the RBACWatcherSet and starts removing the
+// RBACWatchers that are idle. This function is blocking.
+func (s *RBACWatcherSet) Start(ctx context.Context) error {
+	go s.removeIdleWatchers(ctx)
+	return s.cache.Start(ctx)
+}
+
+// removeIdleWatchers is a helper function to periodically remove the RBACWatchers
+// that are idle until the context is closed. This function is blocking.
+func (s *RBACWatcherSet) removeIdleWatchers(ctx context.Context) {
+	interval := s.idleTimeout / 2
+	if interval < minWatcherSweepInterval {
+		interval = minWatcherSweepInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.removeIdle(now.Add(-s.idleTimeout))
+		}
+	}
+}
+
+// removeIdle removes the RBACWatchers that have not been requested since the given
+// time. RBACWatchers with subscribers, such as the ones of open watches, are kept.
+func (s *RBACWatcherSet) removeIdle(since time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, iw := range s.watchers {
+		if iw.lastUsed.Before(since) && !iw.watcher.hasSubscribers() {
+			klog.V(0).Infof("no longer watching RBAC for idle user `%s`", iw.watcher.Identity.User)
+			delete(s.watchers, key)
+		}
+	}
+}
+
+// dispatchHandler is a helper function for creating the cache.ResourceEventHandler of the informer of
+// the given kind, which forwards every event to the RBACWatchers that are in the set when it is handled
+func (s *RBACWatcherSet) dispatchHandler(kind string) cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			for _, w := range s.list() {
+				w.eventHandler(kind).OnAdd(obj)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			for _, w := range s.list() {
+				w.eventHandler(kind).OnUpdate(oldObj, newObj)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			for _, w := range s.list() {
+				w.eventHandler(kind).OnDelete(obj)
+			}
+		},
+	}
+}
+
+// WaitForSync blocks until the informers of the RBACWatcherSet have synced.
+// It returns false if the context is closed before the informers have synced.
+func (s *RBACWatcherSet) WaitForSync(ctx context.Context) bool {
+	if !s.cache.WaitForCacheSync(ctx) {
+		return false
+	}
+
+	atomic.StoreInt32(&s.synced, 1)
+	return true
+}
+
+// HasSynced returns whether or not the informers of the RBACWatcherSet have synced
+func (s *RBACWatcherSet) HasSynced() bool {
+	return atomic.LoadInt32(&s.synced) == 1
+}
+
+// WatcherFor returns the RBACWatcher for the given Identity. The first time an Identity is seen,
+// or when its RBACWatcher was removed for being idle, a new RBACWatcher is added to the set and this
+// function blocks until its permissions have been computed. Identities with the same user and groups
+// share an RBACWatcher.
+func (s *RBACWatcherSet) WatcherFor(ctx context.Context, identity Identity) (*RBACWatcher, error) {
+	key := identity.Key()
+	if w := s.get(key); w != nil {
+		return w, nil
+	}
+
+	s.createMu.Lock()
+	defer s.createMu.Unlock()
+
+	// Another request may have created the RBACWatcher while waiting for the lock
+	if w := s.get(key); w != nil {
+		return w, nil
+	}
+
+	klog.V(0).Infof("watching RBAC for user `%s`", identity.User)
+	w := newRBACWatcher(identity)
+	w.cache = s.cache
+	w.watchNamespaces = s.watchNamespaces
+
+	// The RBACWatcher handles events from the moment it is in the set, so
+	// no change is missed while its permissions are being computed
+	s.mu.Lock()
+	s.watchers[key] = &identityWatcher{watcher: w, lastUsed: time.Now()}
+	s.mu.Unlock()
+
+	if !w.WaitForSync(ctx) {
+		s.mu.Lock()
+		delete(s.watchers, key)
+		s.mu.Unlock()
+		return nil, fmt.Errorf("encountered an error syncing the permissions of user `%s`", identity.User)
+	}
+
+	return w, nil
+}
+
+// get is a helper function to get the synced RBACWatcher with the given key and mark
+// it as requested. It returns nil if there is no RBACWatcher that has synced.
+func (s *RBACWatcherSet) get(key string) *RBACWatcher {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	iw, ok := s.watchers[key]
+	if !ok || !iw.watcher.HasSynced() {
+		return nil
+	}
+
+	iw.lastUsed = time.Now()
+	return iw.watcher
+}
+
+// list is a helper function to get every RBACWatcher of the set
+func (s *RBACWatcherSet) list() []*RBACWatcher {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	watchers := make([]*RBACWatcher, 0, len(s.watchers))
+	for _, iw := range s.watchers {
+		watchers = append(watchers, iw.watcher)
+	}
+	return watchers
+}
@@ -0,0 +1,35 @@
+package rbac
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRBACWatcherSetRemoveIdle(t *testing.T) {
+	now := time.Now()
+	idle := newRBACWatcher(Identity{User: "idle"})
+	active := newRBACWatcher(Identity{User: "active"})
+	watching := newRBACWatcher(Identity{User: "watching"})
+	_, cancel := watching.Subscribe()
+	defer cancel()
+
+	s := NewRBACWatcherSet(time.Minute)
+	s.watchers["idle"] = &identityWatcher{watcher: idle, lastUsed: now.Add(-2 * time.Minute)}
+	s.watchers["active"] = &identityWatcher{watcher: active, lastUsed: now}
+	s.watchers["watching"] = &identityWatcher{watcher: watching, lastUsed: now.Add(-2 * time.Minute)}
+
+	s.removeIdle(now.Add(-time.Minute))
+
+	if _, ok := s.watchers["idle"]; ok {
+		t.Fatalf("expected the idle RBACWatcher to be removed")
+	}
+	if _, ok := s.watchers["active"]; !ok {
+		t.Fatalf("expected the recently requested RBACWatcher to be kept")
+	}
+	if _, ok := s.watchers["watching"]; !ok {
+		t.Fatalf("expected the RBACWatcher with a subscriber to be kept")
+	}
+	if len(s.list()) != 2 {
+		t.Fatalf("expected events to be forwarded to 2 RBACWatchers, got %d", len(s.list()))
+	}
+}
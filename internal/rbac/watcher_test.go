@@ -0,0 +1,39 @@
+package rbac
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	rbac "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestDeleteHandlersUnwrapTombstones(t *testing.T) {
+	w := newRBACWatcher(Identity{User: "user"})
+	w.watchNamespaces = true
+	w.namespaces["default"] = struct{}{}
+	w.clusterContributions["crb"] = Permissions{"/pods": {"list": nil}}
+	w.namespaceContributions["default"] = map[string]Permissions{"rb": {"/pods": {"list": nil}}}
+
+	crb := &rbac.ClusterRoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "crb"}}
+	w.clusterRoleBindingHandler().OnDelete(cache.DeletedFinalStateUnknown{Key: "crb", Obj: crb})
+	if _, ok := w.clusterContributions["crb"]; ok {
+		t.Fatalf("expected the contribution of the deleted ClusterRoleBinding to be removed")
+	}
+
+	rb := &rbac.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "rb", Namespace: "default"}}
+	w.roleBindingHandler().OnDelete(cache.DeletedFinalStateUnknown{Key: "default/rb", Obj: rb})
+	if _, ok := w.namespaceContributions["default"]["rb"]; ok {
+		t.Fatalf("expected the contribution of the deleted RoleBinding to be removed")
+	}
+
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	w.namespaceHandler().OnDelete(cache.DeletedFinalStateUnknown{Key: "default", Obj: ns})
+	if w.Snapshot().HasNamespace("default") {
+		t.Fatalf("expected the deleted Namespace to be removed")
+	}
+
+	// a tombstone of an unexpected type is ignored instead of panicking
+	w.clusterRoleBindingHandler().OnDelete(cache.DeletedFinalStateUnknown{Key: "other", Obj: ns})
+}
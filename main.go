@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"net"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/everettraven/rbac-proxy-poc/internal/handler"
 	"github.com/everettraven/rbac-proxy-poc/internal/proxy"
 	"github.com/everettraven/rbac-proxy-poc/internal/rbac"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
@@ -16,15 +19,56 @@ const (
 	port          = 8001
 	staticPrefix  = "/static/"
 	apiPrefix     = "/"
-	address       = "127.0.0.1"
 	acceptPaths   = proxy.DefaultPathAcceptRE
 	rejectPaths   = proxy.DefaultPathRejectRE
-	acceptHosts   = proxy.DefaultHostAcceptRE
 	rejectMethods = proxy.DefaultMethodRejectRE
 	staticDir     = ""
+
+	// serviceAccountName is the name of the ServiceAccount to watch RBAC for
+	serviceAccountName = "rbac-sa"
+	// serviceAccountNamespaceFile is the file that the namespace of the pod's ServiceAccount is mounted to
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+var (
+	// address is the IP address that the proxy serves on
+	address string
+	// acceptHosts is the comma separated list of regular expressions that the host of a request must match
+	acceptHosts string
+	// maxConcurrentLists is the maximum number of namespaces that are listed concurrently for a cluster level list
+	maxConcurrentLists int
+	// listTimeout is the maximum amount of time that a cluster level list may take
+	listTimeout time.Duration
+	// partialFailurePolicy is how a cluster level list responds when some of its namespaces can not be listed
+	partialFailurePolicy string
+	// readCache is whether or not cluster level lists are served from per-namespace informers
+	readCache bool
+	// readCacheTTL is how long the informers of a resource are kept after they were last read from
+	readCacheTTL time.Duration
+	// impersonate is whether or not callers are authenticated and requests are made as them
+	impersonate bool
+	// authorizerMode is how the permissions of a caller are decided
+	authorizerMode string
+	// authorizationCacheTTL is how long the decisions of the API server's authorizer are cached
+	authorizationCacheTTL time.Duration
+	// identityIdleTimeout is how long the permissions and clients of a caller are kept after its last request
+	identityIdleTimeout time.Duration
 )
 
 func main() {
+	flag.StringVar(&address, "address", "127.0.0.1", "The IP address to serve on, which must be reachable by the callers when the proxy is shared with --impersonate")
+	flag.StringVar(&acceptHosts, "accept-hosts", proxy.DefaultHostAcceptRE, "The comma separated regular expressions of the hosts that requests are accepted for")
+	flag.IntVar(&maxConcurrentLists, "max-concurrent-lists", 10, "The maximum number of namespaces that are listed or deleted from concurrently for a cluster level list or deletecollection")
+	flag.DurationVar(&listTimeout, "list-timeout", 30*time.Second, "The maximum amount of time that a cluster level list or deletecollection may take, 0 for no deadline")
+	flag.StringVar(&partialFailurePolicy, "partial-failure-policy", string(handler.PartialFailurePolicyFail), "How a cluster level list responds when some of its namespaces can not be listed, one of Fail or Warn")
+	flag.BoolVar(&readCache, "read-cache", false, "Serve cluster level lists from informers that are kept for each namespace of the requested resources")
+	flag.DurationVar(&readCacheTTL, "read-cache-ttl", 10*time.Minute, "How long the informers of the read cache are kept after they were last read from")
+	flag.BoolVar(&impersonate, "impersonate", false, "Authenticate the bearer token of each caller with a TokenReview and make requests as the caller using impersonation, instead of as the rbac-sa ServiceAccount")
+	flag.StringVar(&authorizerMode, "authorizer", string(handler.AuthorizerModeRBAC), "How the permissions of a caller are decided, one of RBAC to evaluate the cached RBAC of the cluster or SubjectAccessReview to ask the authorizer of the Kubernetes API server")
+	flag.DurationVar(&authorizationCacheTTL, "authorization-cache-ttl", 10*time.Second, "How long the decisions and discovered namespace permissions of the SubjectAccessReview authorizer are cached")
+	flag.DurationVar(&identityIdleTimeout, "identity-idle-timeout", 10*time.Minute, "How long the permissions and clients of a caller are kept after its last request when the proxy is shared with --impersonate")
+	flag.Parse()
+
 	fmt.Println("RBAC Proxy!")
 
 	err := RunProxy()
@@ -34,22 +78,110 @@ func main() {
 }
 
 func RunProxy() error {
+	policy := handler.PartialFailurePolicy(partialFailurePolicy)
+	if policy != handler.PartialFailurePolicyFail && policy != handler.PartialFailurePolicyWarn {
+		return fmt.Errorf("unknown partial failure policy `%s`", partialFailurePolicy)
+	}
+
+	mode := handler.AuthorizerMode(authorizerMode)
+	if mode != handler.AuthorizerModeRBAC && mode != handler.AuthorizerModeSubjectAccessReview {
+		return fmt.Errorf("unknown authorizer `%s`", authorizerMode)
+	}
+	if mode == handler.AuthorizerModeSubjectAccessReview && authorizationCacheTTL <= 0 {
+		return fmt.Errorf("the authorization cache TTL must be positive, got `%s`", authorizationCacheTTL)
+	}
+	if impersonate && identityIdleTimeout <= 0 {
+		return fmt.Errorf("the identity idle timeout must be positive, got `%s`", identityIdleTimeout)
+	}
+
 	// Create an informer
 	cfg := config.GetConfigOrDie()
-	ctx := context.TODO()
-	defer ctx.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clients, err := handler.NewClients(cfg)
+	if err != nil {
+		return fmt.Errorf("encountered an error creating the handler clients: %w", err)
+	}
+	clients.ImpersonationIdleTimeout = identityIdleTimeout
+
+	var authz handler.Authorizer
+	var impersonation *proxy.Impersonation
+	errs := make(chan error, 3)
+	switch {
+	case impersonate && mode == handler.AuthorizerModeSubjectAccessReview:
+		impersonation = &proxy.Impersonation{
+			Authenticator: proxy.NewTokenReviewAuthenticator(clients.Client),
+			Authorizers:   handler.NewSubjectAccessReviewIdentityAuthorizers(clients, authorizationCacheTTL, identityIdleTimeout),
+		}
+	case impersonate:
+		watchers := rbac.NewRBACWatcherSet(identityIdleTimeout)
+		err = watchers.Initialize(ctx, cfg)
+		if err != nil {
+			return fmt.Errorf("encountered an error initializing the RBAC watchers: %w", err)
+		}
+
+		go func() {
+			errs <- watchers.Start(ctx)
+		}()
 
-	watcher := rbac.NewRBACWatcher("rbac-sa")
-	watcher.Initialize(ctx, cfg)
+		// Requests are rejected as retryable until the RBAC informers have synced
+		go func() {
+			if watchers.WaitForSync(ctx) {
+				fmt.Println("RBAC informers synced")
+			}
+		}()
 
-	go watcher.Start(ctx)
+		impersonation = &proxy.Impersonation{
+			Authenticator: proxy.NewTokenReviewAuthenticator(clients.Client),
+			Authorizers:   handler.NewRBACIdentityAuthorizers(watchers),
+		}
+	case mode == handler.AuthorizerModeSubjectAccessReview:
+		authz = handler.NewSelfSubjectAccessReviewAuthorizer(clients.Client, authorizationCacheTTL)
+	default:
+		watcher := rbac.NewRBACWatcher(getServiceAccountNamespace(), serviceAccountName)
+		err = watcher.Initialize(ctx, cfg)
+		if err != nil {
+			return fmt.Errorf("encountered an error initializing the RBAC watcher: %w", err)
+		}
+
+		go func() {
+			errs <- watcher.Start(ctx)
+		}()
+
+		// Requests are rejected as retryable until the permissions have synced
+		go func() {
+			if watcher.WaitForSync(ctx) {
+				fmt.Println("RBAC permissions synced")
+			}
+		}()
+
+		authz = handler.NewRBACAuthorizer(watcher)
+	}
+
+	if readCache {
+		clients.Cache, err = handler.NewReadCache(cfg, readCacheTTL)
+		if err != nil {
+			return fmt.Errorf("encountered an error creating the read cache: %w", err)
+		}
+		go func() {
+			errs <- clients.Cache.Start(ctx)
+		}()
+	}
 
 	filter := &proxy.FilterServer{
-		AcceptPaths:        proxy.MakeRegexpArrayOrDie(acceptPaths),
-		RejectPaths:        proxy.MakeRegexpArrayOrDie(rejectPaths),
-		AcceptHosts:        proxy.MakeRegexpArrayOrDie(acceptHosts),
-		RejectMethods:      proxy.MakeRegexpArrayOrDie(rejectMethods),
-		PermissionsWatcher: watcher,
+		AcceptPaths:   proxy.MakeRegexpArrayOrDie(acceptPaths),
+		RejectPaths:   proxy.MakeRegexpArrayOrDie(rejectPaths),
+		AcceptHosts:   proxy.MakeRegexpArrayOrDie(acceptHosts),
+		RejectMethods: proxy.MakeRegexpArrayOrDie(rejectMethods),
+		Authorizer:    authz,
+		Clients:       clients,
+		Impersonation: impersonation,
+		HandlerOptions: handler.Options{
+			MaxConcurrentLists:   maxConcurrentLists,
+			ListTimeout:          listTimeout,
+			PartialFailurePolicy: policy,
+		},
 	}
 
 	keepalive, _ := time.ParseDuration("500ms")
@@ -67,7 +199,24 @@ func RunProxy() error {
 		return err
 	}
 	fmt.Fprintf(os.Stdout, "Starting to serve on %s\n", l.Addr().String())
-	return server.ServeOnListener(l)
+	go func() {
+		errs <- server.ServeOnListener(l)
+	}()
+
+	return <-errs
+}
+
+// getServiceAccountNamespace is a helper function to get the namespace of the
+// pod's ServiceAccount. It falls back to the `default` namespace when the proxy
+// is not running in a pod.
+func getServiceAccountNamespace() string {
+	namespace, err := os.ReadFile(serviceAccountNamespaceFile)
+	if err != nil {
+		fmt.Println("unable to read the ServiceAccount namespace, using `default` -- ", err)
+		return "default"
+	}
+
+	return strings.TrimSpace(string(namespace))
 }
 
 /*